@@ -0,0 +1,10 @@
+package cqrs
+
+import "context"
+
+// CheckpointStore records, per named processor, the position of the last event it has processed.
+// LoadCheckpoint returns 0 for a processor without a checkpoint.
+type CheckpointStore interface {
+	SaveCheckpoint(ctx context.Context, name string, position int64) error
+	LoadCheckpoint(ctx context.Context, name string) (int64, error)
+}
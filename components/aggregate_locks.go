@@ -0,0 +1,78 @@
+package components
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// aggregateLocks hands out one mutex per aggregate ID, so that commands against the same aggregate
+// are serialised while commands against different aggregates never contend. Entries are dropped once
+// no goroutine holds or waits for them.
+type aggregateLocks struct {
+	mu    sync.Mutex
+	locks map[string]*aggregateLock
+}
+
+type aggregateLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newAggregateLocks() *aggregateLocks {
+	return &aggregateLocks{locks: make(map[string]*aggregateLock)}
+}
+
+func (l *aggregateLocks) lock(aggregateId string) {
+	l.mu.Lock()
+	lock := l.locks[aggregateId]
+	if lock == nil {
+		lock = &aggregateLock{}
+		l.locks[aggregateId] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+}
+
+func (l *aggregateLocks) unlock(aggregateId string) {
+	l.mu.Lock()
+	lock := l.locks[aggregateId]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, aggregateId)
+	}
+	l.mu.Unlock()
+
+	lock.Unlock()
+}
+
+type heldLockKey struct{}
+
+// heldLock records in a context that the dispatch it belongs to holds an aggregate's lock, so that a
+// dispatch nested inside it, such as one issued by a saga reacting synchronously to the events being
+// persisted, does not wait for its own caller.
+type heldLock struct {
+	locks       *aggregateLocks
+	aggregateId string
+	released    atomic.Bool
+	parent      *heldLock
+}
+
+// lockContext locks the aggregate unless ctx shows the lock is already held further up the call chain,
+// and returns a context recording the lock along with the function releasing it.
+func (l *aggregateLocks) lockContext(ctx context.Context, aggregateId string) (context.Context, func()) {
+	parent, _ := ctx.Value(heldLockKey{}).(*heldLock)
+	for held := parent; held != nil; held = held.parent {
+		if held.locks == l && held.aggregateId == aggregateId && !held.released.Load() {
+			return ctx, func() {}
+		}
+	}
+	l.lock(aggregateId)
+	held := &heldLock{locks: l, aggregateId: aggregateId, parent: parent}
+	return context.WithValue(ctx, heldLockKey{}, held), func() {
+		held.released.Store(true)
+		l.unlock(aggregateId)
+	}
+}
@@ -0,0 +1,79 @@
+package components
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_aggregateLocks_serialisesSameAggregate(t *testing.T) {
+	locks := newAggregateLocks()
+	var wg sync.WaitGroup
+	counter := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			locks.lock(fooId)
+			defer locks.unlock(fooId)
+			current := counter
+			time.Sleep(time.Microsecond)
+			counter = current + 1
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 100, counter)
+	assert.Equal(t, 0, len(locks.locks))
+}
+
+func Test_aggregateLocks_differentAggregatesProceed(t *testing.T) {
+	locks := newAggregateLocks()
+	locks.lock(fooId)
+	defer locks.unlock(fooId)
+
+	acquired := make(chan struct{})
+	go func() {
+		locks.lock(barId)
+		locks.unlock(barId)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("lock on a different aggregate was blocked")
+	}
+}
+
+func Test_aggregateLocks_lockContextReentrant(t *testing.T) {
+	locks := newAggregateLocks()
+	ctx, unlock := locks.lockContext(context.Background(), fooId)
+
+	nested, unlockNested := locks.lockContext(ctx, fooId)
+	unlockNested()
+	assert.Equal(t, 1, len(locks.locks))
+	_, unlockOther := locks.lockContext(nested, barId)
+	unlockOther()
+	unlock()
+	assert.Equal(t, 0, len(locks.locks))
+
+	// once released, the context no longer vouches for the lock
+	acquired := make(chan struct{})
+	locks.lock(fooId)
+	go func() {
+		_, unlock := locks.lockContext(ctx, fooId)
+		unlock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a released lock was treated as held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	locks.unlock(fooId)
+	<-acquired
+}
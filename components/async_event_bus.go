@@ -0,0 +1,212 @@
+package components
+
+import (
+	"context"
+	"github.com/davegarred/cqrs"
+	"hash/fnv"
+	"runtime"
+	"sync"
+)
+
+const defaultQueueSize = 256
+
+// AsyncEventBus hands events to a fixed pool of workers so that query listeners run outside of the
+// publisher's call. Every aggregate is served by a single worker, so events of one aggregate are delivered
+// in the order they were published, while events of different aggregates are delivered in parallel.
+type AsyncEventBus struct {
+	*listenerRegistry
+	mu sync.Mutex
+	// publishing counts the publishers between checking for closure and queueing an event.
+	publishing int
+	// closing is closed by Shutdown to turn publishers away, drained once no publisher can queue any
+	// more events, which tells the workers to empty their queues and stop.
+	closing chan struct{}
+	drained chan struct{}
+	queues  []chan *cqrs.EventEnvelope
+	workers sync.WaitGroup
+
+	pendingMu sync.Mutex
+	pending   int
+	idle      chan struct{}
+}
+
+// NewAsyncEventBus starts an event bus with the given number of workers, each with a queue holding up to
+// queueSize events. Non-positive values fall back to the number of CPUs and a queue of 256 events.
+func NewAsyncEventBus(workers, queueSize int) *AsyncEventBus {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	eventBus := &AsyncEventBus{
+		listenerRegistry: newListenerRegistry(),
+		closing:          make(chan struct{}),
+		drained:          make(chan struct{}),
+		queues:           make([]chan *cqrs.EventEnvelope, workers),
+		idle:             make(chan struct{}),
+	}
+	close(eventBus.idle)
+	for i := range eventBus.queues {
+		eventBus.queues[i] = make(chan *cqrs.EventEnvelope, queueSize)
+		eventBus.workers.Add(1)
+		go eventBus.work(eventBus.queues[i])
+	}
+	return eventBus
+}
+
+// SetRetryPolicy makes the workers retry a query listener that returns an error or panics before
+// dead-lettering the event. Retries hold up the events queued behind it.
+func (eventBus *AsyncEventBus) SetRetryPolicy(policy RetryPolicy) *AsyncEventBus {
+	eventBus.setRetryPolicy(policy)
+	return eventBus
+}
+
+// SetDeadLetterStore replaces the in-memory store that failed events are dead-lettered to.
+func (eventBus *AsyncEventBus) SetDeadLetterStore(store DeadLetterStore) *AsyncEventBus {
+	eventBus.setDeadLetterStore(store)
+	return eventBus
+}
+
+// PublishEvents queues the events for delivery. When the queue of an aggregate's worker is full the call
+// blocks until there is room, or returns ctx.Err() leaving the remaining events unpublished. Once the bus
+// is shut down the remaining events are left unpublished with cqrs.ErrEventBusClosed.
+func (eventBus *AsyncEventBus) PublishEvents(ctx context.Context, events []*cqrs.EventEnvelope) error {
+	for _, envelope := range events {
+		if err := eventBus.enqueue(ctx, envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (eventBus *AsyncEventBus) enqueue(ctx context.Context, envelope *cqrs.EventEnvelope) error {
+	eventBus.mu.Lock()
+	select {
+	case <-eventBus.closing:
+		eventBus.mu.Unlock()
+		return cqrs.ErrEventBusClosed
+	default:
+	}
+	eventBus.publishing++
+	eventBus.mu.Unlock()
+	defer eventBus.donePublishing()
+
+	eventBus.addPending(1)
+	select {
+	case eventBus.queues[eventBus.worker(envelope.AggregateId)] <- envelope:
+		return nil
+	case <-ctx.Done():
+		eventBus.addPending(-1)
+		return ctx.Err()
+	case <-eventBus.closing:
+		eventBus.addPending(-1)
+		return cqrs.ErrEventBusClosed
+	}
+}
+
+func (eventBus *AsyncEventBus) donePublishing() {
+	eventBus.mu.Lock()
+	defer eventBus.mu.Unlock()
+	eventBus.publishing--
+	eventBus.closeDrainedIfDone()
+}
+
+// closeDrainedIfDone closes drained once the bus is closing and no publisher is left. The caller must
+// hold the lock.
+func (eventBus *AsyncEventBus) closeDrainedIfDone() {
+	select {
+	case <-eventBus.closing:
+	default:
+		return
+	}
+	select {
+	case <-eventBus.drained:
+	default:
+		if eventBus.publishing == 0 {
+			close(eventBus.drained)
+		}
+	}
+}
+
+// WaitIdle blocks until every event published so far has been delivered to its listeners.
+func (eventBus *AsyncEventBus) WaitIdle(ctx context.Context) error {
+	eventBus.pendingMu.Lock()
+	idle := eventBus.idle
+	eventBus.pendingMu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting events and waits for the workers to deliver the events already queued, or
+// returns ctx.Err() leaving them to finish in the background. Publishers blocked on a full queue give up
+// with cqrs.ErrEventBusClosed, as do listeners publishing while the queues are emptied.
+func (eventBus *AsyncEventBus) Shutdown(ctx context.Context) error {
+	eventBus.mu.Lock()
+	select {
+	case <-eventBus.closing:
+	default:
+		close(eventBus.closing)
+		eventBus.closeDrainedIfDone()
+	}
+	eventBus.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		eventBus.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (eventBus *AsyncEventBus) work(queue chan *cqrs.EventEnvelope) {
+	defer eventBus.workers.Done()
+	for {
+		select {
+		case envelope := <-queue:
+			eventBus.handle(envelope)
+		case <-eventBus.drained:
+			for {
+				select {
+				case envelope := <-queue:
+					eventBus.handle(envelope)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (eventBus *AsyncEventBus) handle(envelope *cqrs.EventEnvelope) {
+	// there is no caller left to report to, so an event that cannot even be dead-lettered is dropped
+	eventBus.deliver(context.Background(), envelope)
+	eventBus.addPending(-1)
+}
+
+func (eventBus *AsyncEventBus) worker(aggregateId string) int {
+	h := fnv.New32a()
+	h.Write([]byte(aggregateId))
+	return int(h.Sum32() % uint32(len(eventBus.queues)))
+}
+
+func (eventBus *AsyncEventBus) addPending(delta int) {
+	eventBus.pendingMu.Lock()
+	defer eventBus.pendingMu.Unlock()
+	if eventBus.pending == 0 && delta > 0 {
+		eventBus.idle = make(chan struct{})
+	}
+	eventBus.pending += delta
+	if eventBus.pending == 0 {
+		close(eventBus.idle)
+	}
+}
@@ -0,0 +1,176 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncEventBus_orderedPerAggregate(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewAsyncEventBus(4, 8)
+	defer eventBus.Shutdown(context.Background())
+	listener := &orderingEventListener{names: make(map[string][]string)}
+	eventBus.RegisterQueryEventHandlers(listener)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				eventBus.PublishEvents(context.Background(), wrapEvents(fooNamedEvent{id, strconv.Itoa(n)}))
+			}
+		}(fmt.Sprintf("foo_%d", i))
+	}
+	wg.Wait()
+
+	assert.Nil(eventBus.WaitIdle(context.Background()))
+	assert.Equal(10, len(listener.names))
+	for id, names := range listener.names {
+		assert.Equal(50, len(names), id)
+		for n, name := range names {
+			assert.Equal(strconv.Itoa(n), name, id)
+		}
+	}
+}
+
+func TestAsyncEventBus_backpressure(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewAsyncEventBus(1, 1)
+	listener := &blockingEventListener{release: make(chan struct{})}
+	eventBus.RegisterQueryEventHandlers(listener)
+	assert.Nil(eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}, fooCreatedEvent{fooId})))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := eventBus.PublishEvents(ctx, wrapEvents(fooCreatedEvent{fooId}))
+
+	assert.Equal(context.DeadlineExceeded, err)
+	close(listener.release)
+	assert.Nil(eventBus.WaitIdle(context.Background()))
+	assert.Equal(2, listener.count())
+}
+
+func TestAsyncEventBus_shutdownDrains(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewAsyncEventBus(2, 16)
+	listener := &blockingEventListener{release: make(chan struct{})}
+	eventBus.RegisterQueryEventHandlers(listener)
+	assert.Nil(eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}, fooCreatedEvent{"another_foo"}, fooCreatedEvent{fooId})))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, eventBus.Shutdown(ctx))
+	close(listener.release)
+
+	assert.Nil(eventBus.Shutdown(context.Background()))
+	assert.Equal(3, listener.count())
+	assert.Equal(cqrs.ErrEventBusClosed, eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId})))
+}
+
+func TestAsyncEventBus_shutdownReleasesBlockedPublishers(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewAsyncEventBus(1, 1)
+	listener := &blockingEventListener{release: make(chan struct{})}
+	eventBus.RegisterQueryEventHandlers(listener)
+	assert.Nil(eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}, fooCreatedEvent{fooId})))
+	published := make(chan error)
+	go func() {
+		published <- eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	assert.Equal(context.DeadlineExceeded, eventBus.Shutdown(ctx))
+	assert.True(time.Since(started) < time.Second)
+	assert.Equal(cqrs.ErrEventBusClosed, <-published)
+
+	close(listener.release)
+	assert.Nil(eventBus.Shutdown(context.Background()))
+	assert.Equal(2, listener.count())
+}
+
+func TestAsyncEventBus_listenerPublishesDuringShutdown(t *testing.T) {
+	eventBus := NewAsyncEventBus(1, 1)
+	listener := &republishingEventListener{eventBus: eventBus, release: make(chan struct{})}
+	eventBus.RegisterQueryEventHandlers(listener)
+	assert.Nil(t, eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}, fooCreatedEvent{fooId})))
+
+	shutdown := make(chan error)
+	go func() { shutdown <- eventBus.Shutdown(context.Background()) }()
+	close(listener.release)
+
+	select {
+	case err := <-shutdown:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+}
+
+func TestAsyncEventBus_persistAfterShutdown(t *testing.T) {
+	eventBus := NewAsyncEventBus(1, 1)
+	eventStore := persist.NewMemEventStore(eventBus)
+	assert.Nil(t, eventBus.Shutdown(context.Background()))
+
+	assert.Nil(t, eventStore.Persist(context.Background(), fooId, 0, wrapEvents(fooCreatedEvent{fooId})))
+	events, err := eventStore.Load(context.Background(), fooId)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+}
+
+func wrapEvents(events ...cqrs.Event) []*cqrs.EventEnvelope {
+	return cqrs.NewEventEnvelopes(events, cqrs.Metadata{})
+}
+
+type orderingEventListener struct {
+	mu    sync.Mutex
+	names map[string][]string
+}
+
+func (l *orderingEventListener) OnFooNamed(e fooNamedEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.names[e.Id] = append(l.names[e.Id], e.Name)
+}
+
+// blockingEventListener holds up delivery of every event until release is closed.
+type blockingEventListener struct {
+	release chan struct{}
+	mu      sync.Mutex
+	handled int
+}
+
+func (l *blockingEventListener) OnFooCreated(e fooCreatedEvent) {
+	<-l.release
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handled++
+}
+
+// republishingEventListener publishes another event on its bus for every event it receives, once
+// release is closed.
+type republishingEventListener struct {
+	eventBus *AsyncEventBus
+	release  chan struct{}
+}
+
+func (l *republishingEventListener) OnFooCreated(e fooCreatedEvent) {
+	<-l.release
+	l.eventBus.PublishEvents(context.Background(), wrapEvents(fooNamedEvent{e.Id, "a name"}))
+}
+
+func (l *blockingEventListener) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.handled
+}
@@ -0,0 +1,198 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"sync"
+)
+
+const catchUpPageSize = 256
+
+// Subscriber is implemented by the event buses of this package.
+type Subscriber interface {
+	RegisterQueryEventHandlers(listener interface{}) *Subscription
+}
+
+// CatchUpSubscription feeds a listener every event in the store after a given position, first from
+// history and then live from the event bus. Events reach the listener exactly once and in position order:
+// live events the history has already covered are skipped, and any positions a live event jumps over
+// are read from the store first. Only one goroutine delivers to the listener at a time; live events
+// published meanwhile, including those published by the listener itself, are queued and delivered by that
+// goroutine once the current event has been handled.
+type CatchUpSubscription struct {
+	mu        sync.Mutex
+	idle      *sync.Cond
+	store     cqrs.EventStore
+	listeners *listenerRegistry
+	position  int64
+	live      *Subscription
+	// delivering is set while a goroutine delivers to the listener, and queued holds the live events
+	// waiting for it.
+	delivering bool
+	queued     []*cqrs.EventEnvelope
+	// caughtUpTo is called with the position reached after every page of history.
+	caughtUpTo func(position int64)
+	// delivered is called by the delivering goroutine after each event has been handed to the listener.
+	delivered func(ctx context.Context, position int64) error
+}
+
+// SubscribeFrom registers the listener for every event after fromPosition and returns once it has caught
+// up with the store. Live events published meanwhile are held back until the history before them has
+// been delivered. Events published without a position, such as the deadline events of a Scheduler, are
+// delivered as they arrive, without moving the position.
+func SubscribeFrom(ctx context.Context, store cqrs.EventStore, eventBus Subscriber, fromPosition int64, listener interface{}) (*CatchUpSubscription, error) {
+	subscription := newCatchUpSubscription(store, fromPosition, listener)
+	if err := subscription.start(ctx, eventBus); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func newCatchUpSubscription(store cqrs.EventStore, fromPosition int64, listener interface{}) *CatchUpSubscription {
+	subscription := &CatchUpSubscription{
+		store:      store,
+		listeners:  newListenerRegistry(),
+		position:   fromPosition,
+		caughtUpTo: func(int64) {},
+		delivered:  func(context.Context, int64) error { return nil },
+	}
+	subscription.idle = sync.NewCond(&subscription.mu)
+	subscription.listeners.RegisterQueryEventHandlers(listener)
+	return subscription
+}
+
+func (subscription *CatchUpSubscription) start(ctx context.Context, eventBus Subscriber) error {
+	subscription.live = eventBus.RegisterQueryEventHandlers(&catchUpListener{subscription})
+	for {
+		subscription.mu.Lock()
+		for subscription.delivering {
+			subscription.idle.Wait()
+		}
+		subscription.delivering = true
+		subscription.mu.Unlock()
+
+		read, err := subscription.readPage(ctx, catchUpPageSize)
+		if err = subscription.release(ctx, err); err != nil {
+			subscription.Close()
+			return err
+		}
+		if read == 0 {
+			return nil
+		}
+		subscription.caughtUpTo(subscription.Position())
+	}
+}
+
+// Position returns the position of the last event delivered to the listener.
+func (subscription *CatchUpSubscription) Position() int64 {
+	subscription.mu.Lock()
+	defer subscription.mu.Unlock()
+	return subscription.position
+}
+
+// DeadLetters returns the store holding the events the listener failed to handle.
+func (subscription *CatchUpSubscription) DeadLetters() DeadLetterStore {
+	return subscription.listeners.DeadLetters()
+}
+
+func (subscription *CatchUpSubscription) Close() {
+	subscription.live.Close()
+}
+
+// handleLive delivers a live event, or queues it if another delivery is in progress. Errors delivering
+// queued events are returned to the publisher whose call delivered them; the events missed are read from
+// the store when the next live event arrives.
+func (subscription *CatchUpSubscription) handleLive(ctx context.Context, envelope *cqrs.EventEnvelope) error {
+	subscription.mu.Lock()
+	if subscription.delivering {
+		subscription.queued = append(subscription.queued, envelope)
+		subscription.mu.Unlock()
+		return nil
+	}
+	subscription.delivering = true
+	subscription.mu.Unlock()
+
+	return subscription.release(ctx, subscription.deliverLive(ctx, envelope))
+}
+
+// release delivers the live events queued during the caller's delivery and then lets another goroutine
+// deliver. After an error the queued events are dropped instead.
+func (subscription *CatchUpSubscription) release(ctx context.Context, err error) error {
+	for {
+		subscription.mu.Lock()
+		if err != nil || len(subscription.queued) == 0 {
+			subscription.queued = nil
+			subscription.delivering = false
+			subscription.idle.Broadcast()
+			subscription.mu.Unlock()
+			return err
+		}
+		envelope := subscription.queued[0]
+		subscription.queued = subscription.queued[1:]
+		subscription.mu.Unlock()
+		err = subscription.deliverLive(ctx, envelope)
+	}
+}
+
+// deliverLive delivers a live event along with any events before it that have not been delivered yet.
+// The caller must be the delivering goroutine.
+func (subscription *CatchUpSubscription) deliverLive(ctx context.Context, envelope *cqrs.EventEnvelope) error {
+	if envelope.Position == 0 {
+		// not in the store, so neither replayed nor covered by the history
+		return subscription.listeners.deliver(ctx, envelope)
+	}
+	if envelope.Position <= subscription.position {
+		return nil
+	}
+	for subscription.position < envelope.Position-1 {
+		missing := envelope.Position - 1 - subscription.position
+		if missing > catchUpPageSize {
+			missing = catchUpPageSize
+		}
+		read, err := subscription.readPage(ctx, int(missing))
+		if err != nil {
+			return err
+		}
+		if read == 0 {
+			return fmt.Errorf("event at position %d was published before position %d could be read", envelope.Position, subscription.position+1)
+		}
+	}
+	return subscription.deliver(ctx, envelope)
+}
+
+// readPage delivers up to limit events following the current position and returns how many it read. The
+// caller must be the delivering goroutine.
+func (subscription *CatchUpSubscription) readPage(ctx context.Context, limit int) (int, error) {
+	events, err := subscription.store.ReadAll(ctx, subscription.position, limit)
+	if err != nil {
+		return 0, err
+	}
+	for _, envelope := range events {
+		if err := subscription.deliver(ctx, envelope); err != nil {
+			return 0, err
+		}
+	}
+	return len(events), nil
+}
+
+func (subscription *CatchUpSubscription) deliver(ctx context.Context, envelope *cqrs.EventEnvelope) error {
+	if err := subscription.listeners.deliver(ctx, envelope); err != nil {
+		return err
+	}
+	subscription.mu.Lock()
+	subscription.position = envelope.Position
+	subscription.mu.Unlock()
+	return subscription.delivered(ctx, envelope.Position)
+}
+
+// catchUpListener receives every event published on the bus on behalf of a CatchUpSubscription.
+type catchUpListener struct {
+	subscription *CatchUpSubscription
+}
+
+// OnEvent passes on the publisher's context, so that a listener dispatching a command from within a
+// synchronous publish runs under the locks the publisher holds.
+func (l *catchUpListener) OnEvent(ctx context.Context, e cqrs.Event, envelope *cqrs.EventEnvelope) error {
+	return l.subscription.handleLive(ctx, envelope)
+}
@@ -0,0 +1,96 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatchUpSubscription_historyThenLive(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	for i := 0; i < 3; i++ {
+		assert.Nil(eventStore.Persist(context.Background(), fooId, i, wrapEvents(fooNamedEvent{fooId, "a name"})))
+	}
+	listener := &positionListener{}
+
+	subscription, err := SubscribeFrom(context.Background(), eventStore, eventBus, 1, listener)
+	assert.Nil(err)
+	defer subscription.Close()
+	assert.Nil(eventStore.Persist(context.Background(), fooId, 3, wrapEvents(fooNamedEvent{fooId, "a name"}, fooNamedEvent{fooId, "a name"})))
+
+	assert.Equal([]int64{2, 3, 4, 5}, listener.delivered())
+	assert.Equal(int64(5), subscription.Position())
+}
+
+func TestCatchUpSubscription_fillsGapsAndSkipsDuplicates(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(NewEventBus())
+	listener := &positionListener{}
+	subscription, err := SubscribeFrom(context.Background(), eventStore, eventBus, 0, listener)
+	assert.Nil(err)
+	defer subscription.Close()
+
+	var envelopes []*cqrs.EventEnvelope
+	for i := 0; i < 3; i++ {
+		envelope := wrapEvents(fooNamedEvent{fooId, "a name"})
+		assert.Nil(eventStore.Persist(context.Background(), fooId, i, envelope))
+		envelopes = append(envelopes, envelope...)
+	}
+	assert.Nil(eventBus.PublishEvents(context.Background(), envelopes[2:]))
+	assert.Nil(eventBus.PublishEvents(context.Background(), envelopes))
+
+	assert.Equal([]int64{1, 2, 3}, listener.delivered())
+}
+
+func TestCatchUpSubscription_concurrentWriters(t *testing.T) {
+	eventBus := NewAsyncEventBus(4, 16)
+	eventStore := persist.NewMemEventStore(eventBus)
+	listener := &positionListener{}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				eventStore.Persist(context.Background(), id, i, wrapEvents(fooNamedEvent{id, "a name"}))
+			}
+		}(fmt.Sprintf("foo_%d", w))
+	}
+	subscription, err := SubscribeFrom(context.Background(), eventStore, eventBus, 0, listener)
+	assert.Nil(t, err)
+	defer subscription.Close()
+	wg.Wait()
+	assert.Nil(t, eventBus.WaitIdle(context.Background()))
+
+	delivered := listener.delivered()
+	assert.Equal(t, 200, len(delivered))
+	for i, position := range delivered {
+		assert.Equal(t, int64(i+1), position)
+	}
+}
+
+type positionListener struct {
+	mu        sync.Mutex
+	positions []int64
+}
+
+func (l *positionListener) OnEvent(e cqrs.Event, envelope *cqrs.EventEnvelope) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.positions = append(l.positions, envelope.Position)
+}
+
+func (l *positionListener) delivered() []int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]int64{}, l.positions...)
+}
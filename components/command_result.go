@@ -0,0 +1,25 @@
+package components
+
+import "github.com/davegarred/cqrs"
+
+// CommandResult describes the events persisted for a command dispatched with DispatchWithResult.
+type CommandResult struct {
+	AggregateId string
+	// Version is the version of the aggregate's stream after the command, which is the sequence number of
+	// its last event.
+	Version int
+	// Positions holds the global position of each persisted event.
+	Positions []int64
+	Events    []*cqrs.EventEnvelope
+}
+
+// newCommandResult describes the envelopes once the store has stamped them; there must be at least one.
+func newCommandResult(envelopes []*cqrs.EventEnvelope) *CommandResult {
+	last := envelopes[len(envelopes)-1]
+	result := &CommandResult{AggregateId: last.AggregateId, Version: last.Sequence, Events: envelopes}
+	result.Positions = make([]int64, len(envelopes))
+	for i, envelope := range envelopes {
+		result.Positions[i] = envelope.Position
+	}
+	return result
+}
@@ -0,0 +1,67 @@
+package components
+
+import (
+	"context"
+	"github.com/davegarred/cqrs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeadLetter records an event that a query listener kept failing to handle.
+type DeadLetter struct {
+	Id string
+	// Listener names the listener method that failed, e.g. `*projections.OrderView.OnOrderPlaced`.
+	Listener string
+	Envelope *cqrs.EventEnvelope
+	Error    string
+	Attempts int
+	FailedAt time.Time
+}
+
+// DeadLetterStore keeps dead letters until they are replayed. Add replaces a letter with the same Id.
+type DeadLetterStore interface {
+	Add(ctx context.Context, letter DeadLetter) error
+	List(ctx context.Context) ([]DeadLetter, error)
+	Remove(ctx context.Context, id string) error
+}
+
+type MemDeadLetterStore struct {
+	mu      sync.RWMutex
+	letters map[string]DeadLetter
+}
+
+func NewMemDeadLetterStore() *MemDeadLetterStore {
+	return &MemDeadLetterStore{letters: make(map[string]DeadLetter)}
+}
+
+func (s *MemDeadLetterStore) Add(_ context.Context, letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters[letter.Id] = letter
+	return nil
+}
+
+// List returns the dead letters oldest first.
+func (s *MemDeadLetterStore) List(_ context.Context) ([]DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	letters := make([]DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].FailedAt.Equal(letters[j].FailedAt) {
+			return letters[i].Id < letters[j].Id
+		}
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+	return letters, nil
+}
+
+func (s *MemDeadLetterStore) Remove(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.letters, id)
+	return nil
+}
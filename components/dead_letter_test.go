@@ -0,0 +1,111 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus_retriesFailingListener(t *testing.T) {
+	eventBus := NewEventBus().SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+	listener := &flakyEventListener{failures: 2}
+	eventBus.RegisterQueryEventHandlers(listener)
+
+	err := eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, listener.calls)
+	letters, _ := eventBus.DeadLetters().List(context.Background())
+	assert.Equal(t, 0, len(letters))
+}
+
+func TestEventBus_deadLettersPanickingListener(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus()
+	envelopeListener := &envelopeEventListener{}
+	eventBus.RegisterQueryEventHandlers(&panickingEventListener{})
+	eventBus.RegisterQueryEventHandlers(envelopeListener)
+
+	err := eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}))
+
+	assert.Nil(err)
+	assert.Equal(1, len(envelopeListener.envelopes))
+	letters, _ := eventBus.DeadLetters().List(context.Background())
+	assert.Equal(1, len(letters))
+	assert.Equal("*components.panickingEventListener.OnFooCreated", letters[0].Listener)
+	assert.Equal(1, letters[0].Attempts)
+	assert.True(strings.HasPrefix(letters[0].Error, ErrListenerPanicked.Error()))
+}
+
+func TestEventBus_replayDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus().SetRetryPolicy(RetryPolicy{MaxAttempts: 2})
+	listener := &flakyEventListener{failures: 4}
+	eventBus.RegisterQueryEventHandlers(listener)
+	assert.Nil(eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId})))
+
+	err := eventBus.ReplayDeadLetters(context.Background())
+
+	assert.Equal(errFlakyListener, err)
+	letters, _ := eventBus.DeadLetters().List(context.Background())
+	assert.Equal(1, len(letters))
+	assert.Equal(4, letters[0].Attempts)
+
+	assert.Nil(eventBus.ReplayDeadLetters(context.Background()))
+	letters, _ = eventBus.DeadLetters().List(context.Background())
+	assert.Equal(0, len(letters))
+	assert.Equal(5, listener.calls)
+}
+
+func TestEventBus_replayUnregisteredListener(t *testing.T) {
+	eventBus := NewEventBus()
+	eventBus.DeadLetters().Add(context.Background(), DeadLetter{Id: "a_letter", Listener: "*components.goneListener.OnFooCreated", Envelope: cqrs.NewEventEnvelope(fooCreatedEvent{fooId}, cqrs.Metadata{})})
+
+	err := eventBus.ReplayDeadLetters(context.Background())
+
+	assert.True(t, errors.Is(err, cqrs.ErrMisconfiguration))
+	letters, _ := eventBus.DeadLetters().List(context.Background())
+	assert.Equal(t, 1, len(letters))
+}
+
+func TestAsyncEventBus_deadLetters(t *testing.T) {
+	eventBus := NewAsyncEventBus(2, 4)
+	defer eventBus.Shutdown(context.Background())
+	eventBus.RegisterQueryEventHandlers(&panickingEventListener{})
+
+	assert.Nil(t, eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}, fooCreatedEvent{"another_foo"})))
+
+	assert.Nil(t, eventBus.WaitIdle(context.Background()))
+	letters, _ := eventBus.DeadLetters().List(context.Background())
+	assert.Equal(t, 2, len(letters))
+}
+
+var errFlakyListener = errors.New("projection unavailable")
+
+// flakyEventListener fails the given number of calls before it starts succeeding.
+type flakyEventListener struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (l *flakyEventListener) OnFooCreated(e fooCreatedEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls++
+	if l.calls <= l.failures {
+		return errFlakyListener
+	}
+	return nil
+}
+
+type panickingEventListener struct{}
+
+func (*panickingEventListener) OnFooCreated(e fooCreatedEvent) {
+	panic("a projection bug")
+}
@@ -1,39 +1,39 @@
 package components
 
 import (
+	"context"
 	"github.com/davegarred/cqrs"
-	"reflect"
 )
 
 type SynchronousEventBus struct {
-	queryEventListeners map[reflect.Type][]*queryEventListener
+	*listenerRegistry
 }
 
 func NewEventBus() *SynchronousEventBus {
-	return &SynchronousEventBus{make(map[reflect.Type][]*queryEventListener)}
+	return &SynchronousEventBus{listenerRegistry: newListenerRegistry()}
 }
 
-func (eventBus *SynchronousEventBus) RegisterQueryEventHandlers(listener interface{}) {
-	aggregateType := reflect.TypeOf(listener)
-	for i := 0; i < aggregateType.NumMethod(); i++ {
-		f := aggregateType.Method(i)
+// SetRetryPolicy makes the event bus retry a query listener that returns an error or panics before
+// dead-lettering the event. Retries hold up the publisher.
+func (eventBus *SynchronousEventBus) SetRetryPolicy(policy RetryPolicy) *SynchronousEventBus {
+	eventBus.setRetryPolicy(policy)
+	return eventBus
+}
 
-		if hasEventListenerSignature(f) {
-			eventType := f.Type.In(1)
-			queryEventListeners := eventBus.queryEventListeners[eventType]
-			if queryEventListeners == nil {
-				queryEventListeners = make([]*queryEventListener, 0)
-			}
-			queryEventListeners = append(queryEventListeners, NewEventListener(listener, f))
-			eventBus.queryEventListeners[eventType] = queryEventListeners
-		}
-	}
+// SetDeadLetterStore replaces the in-memory store that failed events are dead-lettered to.
+func (eventBus *SynchronousEventBus) SetDeadLetterStore(store DeadLetterStore) *SynchronousEventBus {
+	eventBus.setDeadLetterStore(store)
+	return eventBus
 }
 
-func (eventBus *SynchronousEventBus) PublishEvents(events []cqrs.Event) {
-	for _, event := range events {
-		for _, listener := range eventBus.queryEventListeners[reflect.TypeOf(event)] {
-			listener.applyEvent(event)
+func (eventBus *SynchronousEventBus) PublishEvents(ctx context.Context, events []*cqrs.EventEnvelope) error {
+	for _, envelope := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := eventBus.deliver(ctx, envelope); err != nil {
+			return err
 		}
 	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package components
 
 import (
+	"context"
 	"errors"
 	"github.com/davegarred/cqrs"
 	"testing"
@@ -15,6 +16,19 @@ func TestEventBus_RegisterQueryEventHandlers(t *testing.T) {
 	assert.Equal(t, 4, len(eventBus.queryEventListeners))
 }
 
+func TestEventBus_PublishEventsCancelled(t *testing.T) {
+	eventBus := NewEventBus()
+	listener := &envelopeEventListener{}
+	eventBus.RegisterQueryEventHandlers(listener)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := eventBus.PublishEvents(ctx, cqrs.NewEventEnvelopes([]cqrs.Event{fooCreatedEvent{fooId}}, cqrs.Metadata{}))
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, len(listener.envelopes))
+}
+
 type fooBarEventListener struct {}
 
 func (*fooBarEventListener) OnBarCreated(e barCreatedEvent)       {}
@@ -38,7 +52,6 @@ func (a *fooAggregate) NonCQRSFunction_twoParams(_ string, _ int) {
 }
 func (a *fooAggregate) NonCQRSFunction_oneParam_similarSig(_ string) ([]string, error) {
 	panic("This should never be called")
-	return nil, nil
 }
 func (a *fooAggregate) HandleCreateFoo(e createFooCommand) ([]cqrs.Event, error) {
 	return []cqrs.Event{fooCreatedEvent{e.Id}}, nil
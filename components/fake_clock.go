@@ -0,0 +1,68 @@
+package components
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a cqrs.Clock that only moves when told to, so that tests can fast-forward through
+// deadlines deterministically.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// After returns a channel that receives the time once the clock has been advanced by d.
+func (clock *FakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- clock.now
+		return c
+	}
+	clock.waiters = append(clock.waiters, fakeClockWaiter{clock.now.Add(d), c})
+	return c
+}
+
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.set(clock.now.Add(d))
+}
+
+// Set moves the clock to the given time, which may lie in the past.
+func (clock *FakeClock) Set(now time.Time) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.set(now)
+}
+
+func (clock *FakeClock) set(now time.Time) {
+	clock.now = now
+	waiting := clock.waiters[:0]
+	for _, waiter := range clock.waiters {
+		if waiter.at.After(now) {
+			waiting = append(waiting, waiter)
+		} else {
+			waiter.c <- now
+		}
+	}
+	clock.waiters = waiting
+}
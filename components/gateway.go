@@ -1,67 +1,302 @@
 package components
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/internal/testhooks"
 	"reflect"
+	"sync"
 )
 
 type CommandGateway struct {
+	mu                      sync.RWMutex
+	locks                   *aggregateLocks
 	eventStore              cqrs.EventStore
 	commandHandlers         map[reflect.Type]*aggregateMessageHandler
 	aggregateEventListeners map[reflect.Type]*aggregateMessageHandler
+	interceptors            []Interceptor
+	retryPolicy             RetryPolicy
+	snapshotStore           cqrs.SnapshotStore
+	snapshotPolicy          SnapshotPolicy
+	scheduler               *Scheduler
 }
 
 func NewCommandGateway(eventStore cqrs.EventStore) *CommandGateway {
-	return &CommandGateway{eventStore, make(map[reflect.Type]*aggregateMessageHandler), make(map[reflect.Type]*aggregateMessageHandler)}
+	return &CommandGateway{
+		locks:                   newAggregateLocks(),
+		eventStore:              eventStore,
+		commandHandlers:         make(map[reflect.Type]*aggregateMessageHandler),
+		aggregateEventListeners: make(map[reflect.Type]*aggregateMessageHandler),
+	}
 }
 
 func (gateway *CommandGateway) RegisterAggregate(aggregate interface{}) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
 	aggregateType := reflect.TypeOf(aggregate)
 
 	for i := 0; i < aggregateType.NumMethod(); i++ {
 		f := aggregateType.Method(i)
 
 		if hasCommandHandlerSignature(f) {
-			gateway.commandHandlers[f.Type.In(1)] = NewMessageHandler(aggregateType, f)
+			gateway.commandHandlers[commandParameter(f)] = NewMessageHandler(aggregateType, f)
 		} else if hasEventListenerSignature(f) {
 			gateway.aggregateEventListeners[f.Type.In(1)] = NewMessageHandler(aggregateType, f)
 		}
 	}
 }
 
+// Use adds interceptors around every dispatch. Interceptors run in the order they were added, so the
+// first one added sees the command first and the outcome last.
+func (gateway *CommandGateway) Use(interceptors ...Interceptor) *CommandGateway {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	gateway.interceptors = append(gateway.interceptors, interceptors...)
+	return gateway
+}
+
+// SetRetryPolicy makes the gateway retry commands that fail with a concurrency conflict, reloading the
+// aggregate and handling the command again each time. Commands implementing RetryableCommand can opt out.
+func (gateway *CommandGateway) SetRetryPolicy(policy RetryPolicy) *CommandGateway {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	gateway.retryPolicy = policy
+	return gateway
+}
+
+// SetSnapshotStore makes the gateway restore aggregates implementing cqrs.Snapshotter from their latest
+// snapshot, replaying only the events written after it, and save a new snapshot whenever the policy asks.
+func (gateway *CommandGateway) SetSnapshotStore(store cqrs.SnapshotStore, policy SnapshotPolicy) *CommandGateway {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	gateway.snapshotStore = store
+	gateway.snapshotPolicy = policy
+	return gateway
+}
+
+// SetScheduler makes the scheduler available to command handlers and synchronous event listeners through
+// SchedulerFromContext. Messages a command handler schedules or cancels are held back until its events
+// have been persisted; failing to save them then fails the command, although its events are committed.
+func (gateway *CommandGateway) SetScheduler(scheduler *Scheduler) *CommandGateway {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	gateway.scheduler = scheduler
+	return gateway
+}
+
 func (gateway *CommandGateway) Dispatch(command cqrs.Command) error {
+	return gateway.DispatchContext(context.Background(), command)
+}
+
+// DispatchWithMetadata dispatches a command and stamps the given metadata on the resulting events.
+func (gateway *CommandGateway) DispatchWithMetadata(command cqrs.Command, metadata cqrs.Metadata) error {
+	return gateway.DispatchContext(cqrs.ContextWithMetadata(context.Background(), metadata), command)
+}
+
+// DispatchContext dispatches a command, giving up with ctx.Err() if the context is done before the
+// resulting events are persisted. Metadata attached with cqrs.ContextWithMetadata is stamped on the
+// events; a missing causation ID is generated for the command and a missing correlation ID defaults to it.
+// Commands issued by sagas reacting synchronously to the events are dispatched before it returns, once the
+// aggregate's lock has been released, and their errors are returned along with its own.
+func (gateway *CommandGateway) DispatchContext(ctx context.Context, command cqrs.Command) error {
+	_, err := gateway.dispatchContext(ctx, command)
+	return err
+}
+
+// DispatchWithResult dispatches a command like DispatchContext and reports the events it persisted
+// along with the aggregate's resulting version, sparing callers another read of the store. The result is
+// nil when nothing was persisted, because the command produced no events or an interceptor answered it
+// without reaching the aggregate.
+func (gateway *CommandGateway) DispatchWithResult(ctx context.Context, command cqrs.Command) (*CommandResult, error) {
+	envelopes, err := gateway.dispatchContext(ctx, command)
+	if err != nil || len(envelopes) == 0 {
+		return nil, err
+	}
+	return newCommandResult(envelopes), nil
+}
+
+// dispatchContext returns the events persisted for the command, as passed back through the interceptors.
+func (gateway *CommandGateway) dispatchContext(ctx context.Context, command cqrs.Command) ([]*cqrs.EventEnvelope, error) {
+	metadata := cqrs.MetadataFromContext(ctx)
+	if metadata.CausationId == "" {
+		metadata.CausationId = cqrs.NewId()
+	}
+	if metadata.CorrelationId == "" {
+		metadata.CorrelationId = metadata.CausationId
+	}
+	ctx = cqrs.ContextWithMetadata(ctx, metadata)
+
+	gateway.mu.RLock()
+	dispatch := chain(gateway.interceptors, gateway.dispatch)
+	scheduler := gateway.scheduler
+	gateway.mu.RUnlock()
+	if scheduler != nil && SchedulerFromContext(ctx) == nil {
+		ctx = ContextWithScheduler(ctx, scheduler)
+	}
+	if deferredCommandsFromContext(ctx) != nil {
+		return dispatch(ctx, command)
+	}
+	deferred := &deferredCommands{}
+	envelopes, err := dispatch(contextWithDeferredCommands(ctx, deferred), command)
+	if deferredErr := deferred.dispatch(); deferredErr != nil {
+		return nil, errors.Join(err, deferredErr)
+	}
+	return envelopes, err
+}
+
+func (gateway *CommandGateway) dispatch(ctx context.Context, command cqrs.Command) ([]*cqrs.EventEnvelope, error) {
 	commandType := reflect.TypeOf(command)
+	gateway.mu.RLock()
 	commandHandler := gateway.commandHandlers[commandType]
+	policy := gateway.retryPolicy
+	gateway.mu.RUnlock()
 	if commandHandler == nil {
-		s := fmt.Sprintf("Command handler for %v not configured", commandType)
-		return errors.New(s)
+		return nil, fmt.Errorf("%w: command handler for %v not configured", cqrs.ErrMisconfiguration, commandType)
+	}
+	if retryable, ok := command.(RetryableCommand); ok && !retryable.RetryOnConflict() {
+		policy = RetryPolicy{}
+	}
+
+	for attempt := 1; ; attempt++ {
+		envelopes, err := gateway.dispatchOnce(ctx, commandHandler, command)
+		if err == nil || attempt >= policy.attempts() || !errors.Is(err, cqrs.ErrConcurrencyConflict) {
+			return envelopes, err
+		}
+		if err := policy.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
 	}
+}
 
+// dispatchOnce holds the aggregate's lock from loading through persisting, so the expected version passed
+// to the store can only be stale when the stream is also written from outside this gateway. A command
+// dispatched with the context handed to a synchronous listener of the persisted events runs under the
+// lock already held.
+func (gateway *CommandGateway) dispatchOnce(ctx context.Context, commandHandler *aggregateMessageHandler, command cqrs.Command) ([]*cqrs.EventEnvelope, error) {
 	aggregateId := command.TargetAggregateId()
-	aggregate := gateway.loadAggregate(commandHandler.AggregateType, aggregateId)
+	ctx, unlock := gateway.locks.lockContext(ctx, aggregateId)
+	defer unlock()
+	outcome, _ := ctx.Value(dispatchOutcomeKey{}).(*dispatchOutcome)
+	if outcome != nil {
+		// keep commands dispatched by synchronous listeners of these events from reporting into it
+		ctx = context.WithValue(ctx, dispatchOutcomeKey{}, (*dispatchOutcome)(nil))
+	}
+	if pendingSchedulesFromContext(ctx) != nil {
+		// keep listeners of these events from holding their schedules back with those of the enclosing command
+		ctx = contextWithPendingSchedules(ctx, nil)
+	}
+	aggregate, version, snapshotVersion, err := gateway.loadAggregate(ctx, commandHandler.AggregateType, aggregateId)
+	if err != nil {
+		return nil, err
+	}
 
-	events, err := commandHandler.applyCommand(aggregate, command)
+	observer := testhooks.HandlerObserverFromContext(ctx)
+	if observer != nil {
+		observer.BeforeCommand(aggregate.Interface(), command)
+	}
+	pending := &pendingSchedules{}
+	events, err := commandHandler.applyCommand(contextWithPendingSchedules(ctx, pending), aggregate, command)
+	if observer != nil {
+		observer.AfterCommand(aggregate.Interface(), command, events, err)
+	}
 	if err != nil {
-		return err
+		if outcome != nil {
+			outcome.rejected = true
+		}
+		return nil, err
 	}
-	gateway.eventStore.Persist(aggregateId, events)
-	return nil
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	envelopes := cqrs.NewEventEnvelopes(events, cqrs.MetadataFromContext(ctx))
+	if err := gateway.eventStore.Persist(ctx, aggregateId, version, envelopes); err != nil {
+		return nil, err
+	}
+	if outcome != nil {
+		outcome.persisted = true
+	}
+	if err := pending.commit(context.WithoutCancel(ctx)); err != nil {
+		return nil, err
+	}
+	gateway.snapshot(ctx, aggregate, aggregateId, version, snapshotVersion, envelopes)
+	return envelopes, nil
 }
 
-func (gateway *CommandGateway) loadAggregate(aggregateType reflect.Type, aggregateId string) reflect.Value {
-	events := gateway.eventStore.Load(aggregateId)
-	aggregate := reflect.New(aggregateType.Elem())
-	for _, event := range events {
-		listener := gateway.aggregateEventListeners[reflect.TypeOf(event)]
+// loadAggregate returns the aggregate, its version and the version of the snapshot it was restored from,
+// which is 0 when the whole stream was replayed.
+func (gateway *CommandGateway) loadAggregate(ctx context.Context, aggregateType reflect.Type, aggregateId string) (reflect.Value, int, int, error) {
+	gateway.mu.RLock()
+	snapshotStore := gateway.snapshotStore
+	gateway.mu.RUnlock()
+
+	aggregate, snapshotVersion := reflect.New(aggregateType.Elem()), 0
+	if snapshotStore != nil && canSnapshot(aggregateType) {
+		var err error
+		if aggregate, snapshotVersion, err = restoreSnapshot(ctx, snapshotStore, aggregateType, aggregateId); err != nil {
+			return aggregate, 0, 0, err
+		}
+	}
+	var events []*cqrs.EventEnvelope
+	var err error
+	if snapshotVersion > 0 {
+		events, err = gateway.eventStore.LoadFrom(ctx, aggregateId, snapshotVersion)
+		if err == nil && len(events) == 0 {
+			// the stream may have become shorter than the snapshot, as after restoring it from a backup, in
+			// which case the snapshot is ignored and the whole stream replayed
+			var last []*cqrs.EventEnvelope
+			if last, err = gateway.eventStore.LoadFrom(ctx, aggregateId, snapshotVersion-1); err == nil && len(last) == 0 {
+				aggregate, snapshotVersion = reflect.New(aggregateType.Elem()), 0
+				events, err = gateway.eventStore.Load(ctx, aggregateId)
+			}
+		}
+	} else {
+		events, err = gateway.eventStore.Load(ctx, aggregateId)
+	}
+	if errors.Is(err, cqrs.ErrStreamNotFound) {
+		return reflect.New(aggregateType.Elem()), 0, 0, nil
+	}
+	if err != nil {
+		return aggregate, 0, 0, err
+	}
+	if err := gateway.applyEvents(aggregateType, aggregate, events); err != nil {
+		return aggregate, 0, 0, err
+	}
+	return aggregate, snapshotVersion + len(events), snapshotVersion, nil
+}
+
+func (gateway *CommandGateway) applyEvents(aggregateType reflect.Type, aggregate reflect.Value, events []*cqrs.EventEnvelope) error {
+	gateway.mu.RLock()
+	defer gateway.mu.RUnlock()
+	for _, envelope := range events {
+		listener := gateway.aggregateEventListeners[reflect.TypeOf(envelope.Event)]
 		if listener != nil {
 			if listener.AggregateType != aggregateType {
-				error := fmt.Sprintf("Incorrectly configured event listener, event type %T was produced via %v but has an event listener attached to %v\n", event, aggregateType, listener.AggregateType)
-				panic(error)
+				return fmt.Errorf("%w: event type %T was produced via %v but has an event listener attached to %v", cqrs.ErrMisconfiguration, envelope.Event, aggregateType, listener.AggregateType)
 			}
-			listener.applyEvent(aggregate, event)
+			listener.applyEvent(aggregate, envelope)
 		}
 	}
-	return aggregate
+	return nil
+}
+
+// snapshot saves the state of the aggregate including the events just persisted if the snapshot policy
+// asks for it. The events are already committed, so a snapshot that cannot be taken is skipped; the
+// aggregate is simply replayed from further back on its next load.
+func (gateway *CommandGateway) snapshot(ctx context.Context, aggregate reflect.Value, aggregateId string, version, snapshotVersion int, envelopes []*cqrs.EventEnvelope) {
+	gateway.mu.RLock()
+	store, policy := gateway.snapshotStore, gateway.snapshotPolicy
+	gateway.mu.RUnlock()
+	if store == nil || policy == nil || len(envelopes) == 0 || !canSnapshot(aggregate.Type()) {
+		return
+	}
+	newVersion := version + len(envelopes)
+	if !policy.ShouldSnapshot(aggregate.Type(), newVersion, newVersion-snapshotVersion) {
+		return
+	}
+	if gateway.applyEvents(aggregate.Type(), aggregate, envelopes) != nil {
+		return
+	}
+	takeSnapshot(context.WithoutCancel(ctx), store, aggregate, aggregateId, newVersion)
 }
@@ -1,7 +1,12 @@
 package components
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/davegarred/cqrs"
 	"github.com/davegarred/cqrs/persist"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -41,7 +46,8 @@ func TestCommandGateway_errorOnDispatch(t *testing.T) {
 	err := commandGateway.Dispatch(nameFoo)
 	assert.NotNil(t, err)
 
-	assert.Equal(t, 0, len(eventStore.Load(createFoo.Id)))
+	_, err = eventStore.Load(context.Background(), createFoo.Id)
+	assert.True(t, errors.Is(err, cqrs.ErrStreamNotFound))
 }
 
 func TestCommandGateway_unconfiguredCommand(t *testing.T) {
@@ -51,9 +57,10 @@ func TestCommandGateway_unconfiguredCommand(t *testing.T) {
 	commandGateway.RegisterAggregate(&fooAggregate{})
 
 	err := commandGateway.Dispatch(notConfiguredCommand{})
-	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, cqrs.ErrMisconfiguration))
 
-	assert.Equal(t, 0, len(eventStore.Load(createFoo.Id)))
+	_, err = eventStore.Load(context.Background(), createFoo.Id)
+	assert.True(t, errors.Is(err, cqrs.ErrStreamNotFound))
 }
 
 func TestCommandGateway_bar(t *testing.T) {
@@ -84,8 +91,245 @@ func TestCombinedCommandGateways(t *testing.T) {
 	assert.Equal(t, 4, len(commandGateway.aggregateEventListeners))
 }
 
+func TestCommandGateway_concurrencyConflict(t *testing.T) {
+	eventBus := NewEventBus()
+	eventStore := &racingEventStore{EventStore: persist.NewMemEventStore(eventBus)}
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	assert.Nil(t, commandGateway.Dispatch(createFoo))
+
+	eventStore.interleave = []cqrs.Event{fooNamedEvent{fooId, "a competing name"}}
+	err := commandGateway.Dispatch(nameFoo)
+
+	assert.True(t, errors.Is(err, cqrs.ErrConcurrencyConflict))
+	events, _ := eventStore.Load(context.Background(), fooId)
+	assert.Equal(t, 2, len(events))
+}
+
+func TestCommandGateway_misconfiguredEventListener(t *testing.T) {
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	assert.Nil(t, commandGateway.Dispatch(createFoo))
+	commandGateway.RegisterAggregate(&strayListenerAggregate{})
+
+	err := commandGateway.Dispatch(nameFoo)
+
+	assert.True(t, errors.Is(err, cqrs.ErrMisconfiguration))
+}
+
+func TestCommandGateway_dispatchWithMetadata(t *testing.T) {
+	eventBus := NewEventBus()
+	listener := &envelopeEventListener{}
+	eventBus.RegisterQueryEventHandlers(listener)
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+
+	assert.Nil(t, commandGateway.Dispatch(createFoo))
+	err := commandGateway.DispatchWithMetadata(nameFoo, cqrs.Metadata{CorrelationId: "a_correlation_id", Headers: map[string]string{"user": "a user"}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(listener.envelopes))
+	created, named := listener.envelopes[0], listener.envelopes[1]
+	assert.NotEqual(t, "", created.CausationId)
+	assert.Equal(t, created.CausationId, created.CorrelationId)
+	assert.NotEqual(t, created.CausationId, named.CausationId)
+	assert.Equal(t, "a_correlation_id", named.CorrelationId)
+	assert.Equal(t, "a user", named.Headers["user"])
+	assert.Equal(t, 2, named.Sequence)
+}
+
+func TestCommandGateway_dispatchContextCancelled(t *testing.T) {
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := commandGateway.DispatchContext(ctx, createFoo)
+
+	assert.Equal(t, context.Canceled, err)
+	_, err = eventStore.Load(context.Background(), createFoo.Id)
+	assert.True(t, errors.Is(err, cqrs.ErrStreamNotFound))
+}
+
+func TestCommandGateway_dispatchContextToHandler(t *testing.T) {
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&deadlineAggregate{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, commandGateway.DispatchContext(ctx, createBar))
+	err := commandGateway.DispatchContext(context.WithValue(ctx, cancelKey{}, cancel), configureBar)
+
+	assert.Equal(t, context.Canceled, err)
+	events, _ := eventStore.Load(context.Background(), barId)
+	assert.Equal(t, 1, len(events))
+}
+
+func TestCommandGateway_concurrentDispatch(t *testing.T) {
+	eventBus := NewEventBus()
+	listener := &envelopeEventListener{}
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	const aggregates, commandsPerAggregate = 10, 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, aggregates*commandsPerAggregate)
+	for a := 0; a < aggregates; a++ {
+		id := fmt.Sprintf("foo_%d", a)
+		assert.Nil(t, commandGateway.Dispatch(createFooCommand{id}))
+		for c := 0; c < commandsPerAggregate; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				errs <- commandGateway.Dispatch(nameFooCommand{id, fmt.Sprintf("name %d", c)})
+			}(c)
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		eventBus.RegisterQueryEventHandlers(listener)
+		commandGateway.RegisterAggregate(&barAggregate{})
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+	for a := 0; a < aggregates; a++ {
+		events, err := eventStore.Load(context.Background(), fmt.Sprintf("foo_%d", a))
+		assert.Nil(t, err)
+		assert.Equal(t, commandsPerAggregate+1, len(events))
+	}
+}
+
+func TestCommandGateway_dispatchWithResult(t *testing.T) {
+	assert := assert.New(t)
+	eventStore := persist.NewMemEventStore(NewEventBus())
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&onceFooAggregate{})
+	assert.Nil(eventStore.Persist(context.Background(), barId, 0, wrapEvents(barCreatedEvent{barId})))
+
+	result, err := commandGateway.DispatchWithResult(context.Background(), createFoo)
+	assert.Nil(err)
+	assert.Equal(fooId, result.AggregateId)
+	assert.Equal(1, result.Version)
+	assert.Equal([]int64{2}, result.Positions)
+	assert.Equal([]cqrs.Event{fooCreatedEvent{fooId}}, cqrs.Events(result.Events))
+
+	result, err = commandGateway.DispatchWithResult(context.Background(), nameFoo)
+	assert.Nil(err)
+	assert.Equal(3, result.Version)
+	assert.Equal([]int64{3, 4}, result.Positions)
+	assert.Equal(2, len(result.Events))
+
+	// a command producing no events has nothing to report
+	result, err = commandGateway.DispatchWithResult(context.Background(), createFoo)
+	assert.Nil(err)
+	assert.Nil(result)
+
+	_, err = commandGateway.DispatchWithResult(context.Background(), notConfiguredCommand{fooId})
+	assert.True(errors.Is(err, cqrs.ErrMisconfiguration))
+}
+
+func TestCommandGateway_dispatchWithResultIgnoresNestedCommands(t *testing.T) {
+	eventBus := NewEventBus()
+	commandGateway := NewCommandGateway(persist.NewMemEventStore(eventBus))
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	sagaManager := NewSagaManager(commandGateway, persist.NewMemSagaStore())
+	assert.Nil(t, sagaManager.RegisterSaga(&fooNamingSaga{}))
+	eventBus.RegisterQueryEventHandlers(sagaManager)
+
+	result, err := commandGateway.DispatchWithResult(context.Background(), createFoo)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.Version)
+	assert.Equal(t, []int64{1}, result.Positions)
+}
+
 type notConfiguredCommand struct {
 	Id string
 }
 
 func (e notConfiguredCommand) TargetAggregateId() string { return e.Id }
+
+type envelopeEventListener struct {
+	mu        sync.Mutex
+	envelopes []*cqrs.EventEnvelope
+}
+
+func (l *envelopeEventListener) OnFooCreated(e fooCreatedEvent, envelope *cqrs.EventEnvelope) {
+	l.record(envelope)
+}
+func (l *envelopeEventListener) OnFooNamed(e fooNamedEvent, envelope *cqrs.EventEnvelope) {
+	l.record(envelope)
+}
+func (l *envelopeEventListener) record(envelope *cqrs.EventEnvelope) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.envelopes = append(l.envelopes, envelope)
+}
+
+// onceFooAggregate ignores repeated creation and names a foo twice over.
+type onceFooAggregate struct {
+	created bool
+}
+
+func (a *onceFooAggregate) HandleCreateFoo(c createFooCommand) ([]cqrs.Event, error) {
+	if a.created {
+		return nil, nil
+	}
+	return []cqrs.Event{fooCreatedEvent{c.Id}}, nil
+}
+func (a *onceFooAggregate) HandleNameFoo(c nameFooCommand) ([]cqrs.Event, error) {
+	return []cqrs.Event{fooNamedEvent{c.Id, c.Name}, fooNamedEvent{c.Id, c.Name}}, nil
+}
+func (a *onceFooAggregate) OnFooCreated(e fooCreatedEvent) {
+	a.created = true
+}
+
+// deadlineAggregate cancels the dispatch context from within its handler, standing in for a handler
+// that is still working when the caller gives up.
+type deadlineAggregate struct{}
+
+func (a *deadlineAggregate) HandleCreateBar(ctx context.Context, c createBarCommand) ([]cqrs.Event, error) {
+	return []cqrs.Event{barCreatedEvent{c.Id}}, nil
+}
+func (a *deadlineAggregate) HandleConfigureBar(ctx context.Context, c configureBarCommand) ([]cqrs.Event, error) {
+	cancel := ctx.Value(cancelKey{})
+	if cancel != nil {
+		cancel.(context.CancelFunc)()
+	}
+	return []cqrs.Event{barConfiguredEvent{c.Id, c.Configuration}}, nil
+}
+
+type cancelKey struct{}
+
+type strayListenerAggregate struct{}
+
+func (a *strayListenerAggregate) OnFooCreated(e fooCreatedEvent) {}
+
+// racingEventStore appends a competing event after each Load, one per Load until it runs out,
+// to simulate a concurrent writer.
+type racingEventStore struct {
+	cqrs.EventStore
+	interleave []cqrs.Event
+}
+
+func (s *racingEventStore) Load(ctx context.Context, aggregateId string) ([]*cqrs.EventEnvelope, error) {
+	events, err := s.EventStore.Load(ctx, aggregateId)
+	if len(s.interleave) > 0 {
+		s.EventStore.Persist(ctx, aggregateId, cqrs.AnyVersion, cqrs.NewEventEnvelopes(s.interleave[:1], cqrs.Metadata{}))
+		s.interleave = s.interleave[1:]
+	}
+	return events, err
+}
@@ -0,0 +1,44 @@
+package components
+
+import (
+	"context"
+	"github.com/davegarred/cqrs"
+)
+
+// DispatchFunc handles a command and returns the events that were persisted as a result.
+type DispatchFunc func(ctx context.Context, command cqrs.Command) ([]*cqrs.EventEnvelope, error)
+
+// Interceptor wraps command dispatch. It may inspect or replace the command before calling next,
+// short-circuit by returning without calling next, and inspect the events or error next returns.
+type Interceptor func(ctx context.Context, command cqrs.Command, next DispatchFunc) ([]*cqrs.EventEnvelope, error)
+
+// BeforeHandle builds an interceptor that runs before the command is handled. The hook returns the
+// command to dispatch, which need not be the one it was given, or an error to reject it.
+func BeforeHandle(hook func(ctx context.Context, command cqrs.Command) (cqrs.Command, error)) Interceptor {
+	return func(ctx context.Context, command cqrs.Command, next DispatchFunc) ([]*cqrs.EventEnvelope, error) {
+		command, err := hook(ctx, command)
+		if err != nil {
+			return nil, err
+		}
+		return next(ctx, command)
+	}
+}
+
+// AfterHandle builds an interceptor that observes the outcome of a dispatch, whether it succeeded or not.
+func AfterHandle(hook func(ctx context.Context, command cqrs.Command, events []*cqrs.EventEnvelope, err error)) Interceptor {
+	return func(ctx context.Context, command cqrs.Command, next DispatchFunc) ([]*cqrs.EventEnvelope, error) {
+		events, err := next(ctx, command)
+		hook(ctx, command, events, err)
+		return events, err
+	}
+}
+
+func chain(interceptors []Interceptor, dispatch DispatchFunc) DispatchFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], dispatch
+		dispatch = func(ctx context.Context, command cqrs.Command) ([]*cqrs.EventEnvelope, error) {
+			return interceptor(ctx, command, next)
+		}
+	}
+	return dispatch
+}
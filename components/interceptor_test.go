@@ -0,0 +1,124 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandGateway_interceptorOrder(t *testing.T) {
+	commandGateway, _ := newInterceptorTestGateway()
+	var trace []string
+	commandGateway.
+		Use(tracingInterceptor("outer", &trace)).
+		Use(BeforeHandle(func(ctx context.Context, command cqrs.Command) (cqrs.Command, error) {
+			trace = append(trace, "before")
+			return command, nil
+		})).
+		Use(AfterHandle(func(ctx context.Context, command cqrs.Command, events []*cqrs.EventEnvelope, err error) {
+			trace = append(trace, "after")
+		})).
+		Use(tracingInterceptor("inner", &trace))
+
+	err := commandGateway.Dispatch(createFoo)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"outer in", "before", "inner in", "inner out", "after", "outer out"}, trace)
+}
+
+func TestCommandGateway_interceptorReplacesCommand(t *testing.T) {
+	commandGateway, eventStore := newInterceptorTestGateway()
+	commandGateway.Use(BeforeHandle(func(ctx context.Context, command cqrs.Command) (cqrs.Command, error) {
+		if c, ok := command.(nameFooCommand); ok {
+			c.Name = "a replaced name"
+			return c, nil
+		}
+		return command, nil
+	}))
+
+	assert.Nil(t, commandGateway.Dispatch(createFoo))
+	assert.Nil(t, commandGateway.Dispatch(nameFoo))
+
+	events, _ := eventStore.Load(context.Background(), fooId)
+	assert.Equal(t, fooNamedEvent{fooId, "a replaced name"}, events[1].Event)
+}
+
+func TestCommandGateway_interceptorShortCircuits(t *testing.T) {
+	commandGateway, eventStore := newInterceptorTestGateway()
+	rejected := errors.New("not authorized")
+	commandGateway.Use(BeforeHandle(func(ctx context.Context, command cqrs.Command) (cqrs.Command, error) {
+		return nil, rejected
+	}))
+
+	err := commandGateway.Dispatch(createFoo)
+
+	assert.Equal(t, rejected, err)
+	_, err = eventStore.Load(context.Background(), fooId)
+	assert.True(t, errors.Is(err, cqrs.ErrStreamNotFound))
+}
+
+func TestCommandGateway_interceptorSeesOutcome(t *testing.T) {
+	commandGateway, _ := newInterceptorTestGateway()
+	var seenEvents []*cqrs.EventEnvelope
+	var seenErr error
+	commandGateway.Use(AfterHandle(func(ctx context.Context, command cqrs.Command, events []*cqrs.EventEnvelope, err error) {
+		seenEvents, seenErr = events, err
+	}))
+
+	assert.Nil(t, commandGateway.Dispatch(createFoo))
+	assert.Equal(t, 1, len(seenEvents))
+	assert.Equal(t, fooCreatedEvent{fooId}, seenEvents[0].Event)
+	assert.Equal(t, 1, seenEvents[0].Sequence)
+	assert.Nil(t, seenErr)
+
+	err := commandGateway.Dispatch(nameFooCommand{"an_uncreated_foo", "a name"})
+	assert.NotNil(t, err)
+	assert.Nil(t, seenEvents)
+	assert.Equal(t, err, seenErr)
+}
+
+func TestCommandGateway_interceptorSeesMetadata(t *testing.T) {
+	commandGateway, _ := newInterceptorTestGateway()
+	var metadata cqrs.Metadata
+	commandGateway.Use(BeforeHandle(func(ctx context.Context, command cqrs.Command) (cqrs.Command, error) {
+		metadata = cqrs.MetadataFromContext(ctx)
+		return command, nil
+	}))
+
+	assert.Nil(t, commandGateway.DispatchWithMetadata(createFoo, cqrs.Metadata{CorrelationId: "a_correlation_id"}))
+
+	assert.NotEqual(t, "", metadata.CausationId)
+	assert.Equal(t, "a_correlation_id", metadata.CorrelationId)
+}
+
+func TestCommandGateway_interceptorAnswersDispatchWithResult(t *testing.T) {
+	commandGateway, _ := newInterceptorTestGateway()
+	commandGateway.Use(func(ctx context.Context, command cqrs.Command, next DispatchFunc) ([]*cqrs.EventEnvelope, error) {
+		return nil, nil
+	})
+
+	result, err := commandGateway.DispatchWithResult(context.Background(), createFoo)
+
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+}
+
+func newInterceptorTestGateway() (*CommandGateway, cqrs.EventStore) {
+	eventStore := persist.NewMemEventStore(NewEventBus())
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	return commandGateway, eventStore
+}
+
+func tracingInterceptor(name string, trace *[]string) Interceptor {
+	return func(ctx context.Context, command cqrs.Command, next DispatchFunc) ([]*cqrs.EventEnvelope, error) {
+		*trace = append(*trace, name+" in")
+		events, err := next(ctx, command)
+		*trace = append(*trace, name+" out")
+		return events, err
+	}
+}
@@ -0,0 +1,217 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// listenerRegistry holds the query event listeners of an event bus, keyed by the event type they take,
+// and delivers events to them. A listener that still fails once the retry policy is exhausted has the
+// event dead-lettered rather than holding up the events behind it.
+//
+// A listener taking an interface that embeds cqrs.Event, or cqrs.Event itself, receives every event
+// implementing it. Each event goes to its listeners in the order they were registered; the listeners
+// resolved for an event type are cached until the next registration.
+type listenerRegistry struct {
+	mu                  sync.RWMutex
+	queryEventListeners map[reflect.Type][]*queryEventListener
+	registered          int
+	resolved            map[reflect.Type][]*queryEventListener
+	retryPolicy         RetryPolicy
+	deadLetters         DeadLetterStore
+}
+
+func newListenerRegistry() *listenerRegistry {
+	return &listenerRegistry{
+		queryEventListeners: make(map[reflect.Type][]*queryEventListener),
+		resolved:            make(map[reflect.Type][]*queryEventListener),
+		deadLetters:         NewMemDeadLetterStore(),
+	}
+}
+
+// RegisterQueryEventHandlers subscribes every event listener method of the listener. The returned
+// subscription removes exactly these subscriptions again.
+func (registry *listenerRegistry) RegisterQueryEventHandlers(listener interface{}) *Subscription {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	subscription := &Subscription{registry: registry}
+	aggregateType := reflect.TypeOf(listener)
+	for i := 0; i < aggregateType.NumMethod(); i++ {
+		f := aggregateType.Method(i)
+
+		if hasQueryEventListenerSignature(f) {
+			eventType := eventParameter(f)
+			queryEventListeners := registry.queryEventListeners[eventType]
+			if queryEventListeners == nil {
+				queryEventListeners = make([]*queryEventListener, 0)
+			}
+			eventListener := NewEventListener(listener, f)
+			eventListener.order = registry.registered
+			registry.registered++
+			// a new slice every time, so that publishers iterating over the old one are unaffected
+			queryEventListeners = append(queryEventListeners[:len(queryEventListeners):len(queryEventListeners)], eventListener)
+			registry.queryEventListeners[eventType] = queryEventListeners
+			subscription.listeners = append(subscription.listeners, eventListener)
+		}
+	}
+	registry.resolved = make(map[reflect.Type][]*queryEventListener)
+	return subscription
+}
+
+// Unsubscribe removes every subscription of the listener, however often it was registered. Events already
+// being published when it is called may still reach the listener.
+func (registry *listenerRegistry) Unsubscribe(listener interface{}) {
+	if listener == nil || !reflect.TypeOf(listener).Comparable() {
+		return
+	}
+	registry.remove(func(eventListener *queryEventListener) bool {
+		return eventListener.Query == listener
+	})
+}
+
+func (registry *listenerRegistry) remove(matches func(*queryEventListener) bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for eventType, queryEventListeners := range registry.queryEventListeners {
+		remaining := make([]*queryEventListener, 0, len(queryEventListeners))
+		for _, eventListener := range queryEventListeners {
+			if !matches(eventListener) {
+				remaining = append(remaining, eventListener)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(registry.queryEventListeners, eventType)
+		} else if len(remaining) < len(queryEventListeners) {
+			registry.queryEventListeners[eventType] = remaining
+		}
+	}
+	registry.resolved = make(map[reflect.Type][]*queryEventListener)
+}
+
+// DeadLetters returns the store that events are dead-lettered to.
+func (registry *listenerRegistry) DeadLetters() DeadLetterStore {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return registry.deadLetters
+}
+
+// ReplayDeadLetters delivers every dead-lettered event again to the listener that failed it, or to every
+// listener of that name when several instances of one type are registered. Letters that are handled
+// are removed; letters that fail again stay in the store, and the first such failure is returned.
+func (registry *listenerRegistry) ReplayDeadLetters(ctx context.Context) error {
+	deadLetters := registry.DeadLetters()
+	letters, err := deadLetters.List(ctx)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, letter := range letters {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var failure error
+		matched := false
+		for _, listener := range registry.listenersFor(reflect.TypeOf(letter.Envelope.Event)) {
+			if listener.name() != letter.Listener {
+				continue
+			}
+			matched = true
+			if attempts, err := registry.attempt(ctx, listener, letter.Envelope); err != nil {
+				letter.Attempts += attempts
+				letter.Error = err.Error()
+				letter.FailedAt = time.Now().UTC()
+				failure = err
+			}
+		}
+		if !matched {
+			failure = fmt.Errorf("%w: listener %s is not registered", cqrs.ErrMisconfiguration, letter.Listener)
+		}
+		if failure == nil {
+			err = deadLetters.Remove(ctx, letter.Id)
+		} else {
+			err = deadLetters.Add(ctx, letter)
+		}
+		if err == nil {
+			err = failure
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (registry *listenerRegistry) setRetryPolicy(policy RetryPolicy) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.retryPolicy = policy
+}
+
+func (registry *listenerRegistry) setDeadLetterStore(store DeadLetterStore) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.deadLetters = store
+}
+
+func (registry *listenerRegistry) listenersFor(eventType reflect.Type) []*queryEventListener {
+	registry.mu.RLock()
+	listeners, ok := registry.resolved[eventType]
+	registry.mu.RUnlock()
+	if ok {
+		return listeners
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	listeners = make([]*queryEventListener, 0)
+	for listenerType, candidates := range registry.queryEventListeners {
+		if listenerType == eventType || listenerType.Kind() == reflect.Interface && eventType.Implements(listenerType) {
+			listeners = append(listeners, candidates...)
+		}
+	}
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].order < listeners[j].order })
+	registry.resolved[eventType] = listeners
+	return listeners
+}
+
+// deliver hands the event to each of its listeners in turn. Only a failure to dead-letter is returned.
+func (registry *listenerRegistry) deliver(ctx context.Context, envelope *cqrs.EventEnvelope) error {
+	for _, listener := range registry.listenersFor(reflect.TypeOf(envelope.Event)) {
+		attempts, err := registry.attempt(ctx, listener, envelope)
+		if err == nil {
+			continue
+		}
+		letter := DeadLetter{
+			Id:       cqrs.NewId(),
+			Listener: listener.name(),
+			Envelope: envelope,
+			Error:    err.Error(),
+			Attempts: attempts,
+			FailedAt: time.Now().UTC(),
+		}
+		if err := registry.DeadLetters().Add(ctx, letter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (registry *listenerRegistry) attempt(ctx context.Context, listener *queryEventListener, envelope *cqrs.EventEnvelope) (int, error) {
+	registry.mu.RLock()
+	policy := registry.retryPolicy
+	registry.mu.RUnlock()
+	for attempt := 1; ; attempt++ {
+		err := listener.applyEvent(ctx, envelope)
+		if err == nil || attempt >= policy.attempts() {
+			return attempt, err
+		}
+		if policy.wait(ctx, attempt) != nil {
+			return attempt, err
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus_interfaceSubscriptions(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus()
+	calls := &callLog{}
+	eventBus.RegisterQueryEventHandlers(&auditEventListener{calls})
+	eventBus.RegisterQueryEventHandlers(&allEventsListener{calls})
+	eventBus.RegisterQueryEventHandlers(&fooNamedListener{calls})
+
+	assert.Nil(eventBus.PublishEvents(context.Background(), wrapEvents(fooCreatedEvent{fooId}, auditedFooEvent{fooId}, fooNamedEvent{fooId, "a name"})))
+
+	assert.Equal([]string{
+		"all components.fooCreatedEvent",
+		"audit components.auditedFooEvent", "all components.auditedFooEvent",
+		"all components.fooNamedEvent", "named components.fooNamedEvent",
+	}, calls.entries())
+}
+
+func TestEventBus_resolutionCacheReset(t *testing.T) {
+	eventBus := NewEventBus()
+	calls := &callLog{}
+	eventBus.RegisterQueryEventHandlers(&fooNamedListener{calls})
+	assert.Nil(t, eventBus.PublishEvents(context.Background(), wrapEvents(fooNamedEvent{fooId, "a name"})))
+
+	eventBus.RegisterQueryEventHandlers(&allEventsListener{calls})
+	assert.Nil(t, eventBus.PublishEvents(context.Background(), wrapEvents(fooNamedEvent{fooId, "a name"})))
+
+	assert.Equal(t, []string{"named components.fooNamedEvent", "named components.fooNamedEvent", "all components.fooNamedEvent"}, calls.entries())
+}
+
+type auditableEvent interface {
+	cqrs.Event
+	Audited() bool
+}
+
+type auditedFooEvent struct {
+	Id string
+}
+
+func (e auditedFooEvent) AggregateId() string { return e.Id }
+func (e auditedFooEvent) Audited() bool       { return true }
+
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(listener string, event cqrs.Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, fmt.Sprintf("%s %T", listener, event))
+}
+
+func (l *callLog) entries() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.calls...)
+}
+
+type auditEventListener struct{ calls *callLog }
+
+func (l *auditEventListener) OnAuditable(e auditableEvent) { l.calls.add("audit", e) }
+
+type allEventsListener struct{ calls *callLog }
+
+func (l *allEventsListener) OnEvent(e cqrs.Event) { l.calls.add("all", e) }
+
+type fooNamedListener struct{ calls *callLog }
+
+func (l *fooNamedListener) OnFooNamed(e fooNamedEvent) { l.calls.add("named", e) }
@@ -1,21 +1,29 @@
 package components
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/davegarred/cqrs"
 	"reflect"
 )
 
+var ErrListenerPanicked = errors.New("query event listener panicked")
+
 var (
 	commandInterface    = reflect.TypeOf((*cqrs.Command)(nil)).Elem()
 	eventInterface      = reflect.TypeOf((*cqrs.Event)(nil)).Elem()
 	eventSliceInterface = reflect.TypeOf([]cqrs.Event{})
 	errorInterface      = reflect.TypeOf((*error)(nil)).Elem()
+	envelopeType        = reflect.TypeOf(&cqrs.EventEnvelope{})
+	contextInterface    = reflect.TypeOf((*context.Context)(nil)).Elem()
 )
 
 type aggregateMessageHandler struct {
 	AggregateType reflect.Type
 	FuncName      string
 	F             reflect.Value
+	WithEnvelope  bool
 }
 
 func NewMessageHandler(aggregateType reflect.Type, f reflect.Method) *aggregateMessageHandler {
@@ -23,25 +31,34 @@ func NewMessageHandler(aggregateType reflect.Type, f reflect.Method) *aggregateM
 		AggregateType: aggregateType,
 		FuncName:      f.Name,
 		F:             f.Func,
+		WithEnvelope:  takesEnvelope(f),
 	}
 }
 
 type queryEventListener struct {
-	Query    interface{}
-	FuncName string
-	F        reflect.Value
+	Query        interface{}
+	FuncName     string
+	F            reflect.Value
+	WithContext  bool
+	WithEnvelope bool
+	order        int
 }
 
 func NewEventListener(query interface{}, f reflect.Method) *queryEventListener {
 	return &queryEventListener{
-		Query:    query,
-		FuncName: f.Name,
-		F:        f.Func,
+		Query:        query,
+		FuncName:     f.Name,
+		F:            f.Func,
+		WithContext:  takesContext(f),
+		WithEnvelope: takesEnvelope(f),
 	}
 }
 
-func (handler *aggregateMessageHandler) applyCommand(aggregate reflect.Value, command cqrs.Command) ([]cqrs.Event, error) {
+func (handler *aggregateMessageHandler) applyCommand(ctx context.Context, aggregate reflect.Value, command cqrs.Command) ([]cqrs.Event, error) {
 	in := []reflect.Value{aggregate, reflect.ValueOf(command)}
+	if handler.F.Type().NumIn() == 3 {
+		in = []reflect.Value{aggregate, reflect.ValueOf(ctx), reflect.ValueOf(command)}
+	}
 	response := handler.F.Call(in)
 	err := response[1].Interface()
 	if err != nil {
@@ -51,29 +68,101 @@ func (handler *aggregateMessageHandler) applyCommand(aggregate reflect.Value, co
 	return events, nil
 }
 
-func (handler *aggregateMessageHandler) applyEvent(aggregate reflect.Value, event cqrs.Event) {
-	in := []reflect.Value{aggregate, reflect.ValueOf(event)}
-	handler.F.Call(in)
+func (handler *aggregateMessageHandler) applyEvent(aggregate reflect.Value, envelope *cqrs.EventEnvelope) {
+	handler.F.Call(eventArguments(aggregate, envelope, handler.WithEnvelope))
+}
+
+// applyEvent returns the error of listeners declared to return one, and turns a panic into an error
+// wrapping ErrListenerPanicked.
+func (handler *queryEventListener) applyEvent(ctx context.Context, envelope *cqrs.EventEnvelope) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %s: %v", ErrListenerPanicked, handler.name(), r)
+		}
+	}()
+	in := eventArguments(reflect.ValueOf(handler.Query), envelope, handler.WithEnvelope)
+	if handler.WithContext {
+		in = append([]reflect.Value{in[0], reflect.ValueOf(ctx)}, in[1:]...)
+	}
+	response := handler.F.Call(in)
+	if len(response) == 1 && !response[0].IsNil() {
+		return response[0].Interface().(error)
+	}
+	return nil
 }
 
-func (handler *queryEventListener) applyEvent(event cqrs.Event) {
-	in := []reflect.Value{reflect.ValueOf(handler.Query), reflect.ValueOf(event)}
-	handler.F.Call(in)
+// name identifies the listener method, e.g. `*projections.OrderView.OnOrderPlaced`.
+func (handler *queryEventListener) name() string {
+	return fmt.Sprintf("%T.%s", handler.Query, handler.FuncName)
 }
 
+func eventArguments(receiver reflect.Value, envelope *cqrs.EventEnvelope, withEnvelope bool) []reflect.Value {
+	in := []reflect.Value{receiver, reflect.ValueOf(envelope.Event)}
+	if withEnvelope {
+		in = append(in, reflect.ValueOf(envelope))
+	}
+	return in
+}
+
+// hasCommandHandlerSignature matches both `Handle(c SomeCommand) ([]cqrs.Event, error)` and
+// `Handle(ctx context.Context, c SomeCommand) ([]cqrs.Event, error)`.
 func hasCommandHandlerSignature(f reflect.Method) bool {
-	if f.Type.NumIn() != 2 || f.Type.NumOut() != 2 {
+	if f.Type.NumIn() < 2 || f.Type.NumIn() > 3 || f.Type.NumOut() != 2 {
+		return false
+	}
+	if f.Type.NumIn() == 3 && f.Type.In(1) != contextInterface {
 		return false
 	}
-	takesCommand := f.Type.In(1).Implements(commandInterface)
+	takesCommand := commandParameter(f).Implements(commandInterface)
 	returnsEventsFirst := f.Type.Out(0) == eventSliceInterface
 	returnsErrorSecond := f.Type.Out(1).Implements(errorInterface)
 	return takesCommand && returnsEventsFirst && returnsErrorSecond
 }
+
+func commandParameter(f reflect.Method) reflect.Type {
+	return f.Type.In(f.Type.NumIn() - 1)
+}
+
+// hasEventListenerSignature matches both `On(e SomeEvent)` and `On(e SomeEvent, envelope *cqrs.EventEnvelope)`,
+// the latter for listeners that need the event's metadata.
 func hasEventListenerSignature(f reflect.Method) bool {
-	if f.Type.NumIn() != 2 || f.Type.NumOut() > 0 {
+	return f.Type.NumOut() == 0 && takesEventArguments(f, 1)
+}
+
+// hasQueryEventListenerSignature additionally allows query listeners to take a context.Context first and
+// to return an error, which makes the event bus retry the event and eventually dead-letter it.
+func hasQueryEventListenerSignature(f reflect.Method) bool {
+	returnsNothingOrError := f.Type.NumOut() == 0 || f.Type.NumOut() == 1 && f.Type.Out(0) == errorInterface
+	return returnsNothingOrError && takesEventArguments(f, eventParameterIndex(f))
+}
+
+func takesEventArguments(f reflect.Method, first int) bool {
+	arguments := f.Type.NumIn() - first
+	if arguments < 1 || arguments > 2 {
 		return false
 	}
-	takesEvent := f.Type.In(1).Implements(eventInterface)
+	if arguments == 2 && !takesEnvelope(f) {
+		return false
+	}
+	takesEvent := f.Type.In(first).Implements(eventInterface)
 	return takesEvent
 }
+
+func eventParameter(f reflect.Method) reflect.Type {
+	return f.Type.In(eventParameterIndex(f))
+}
+
+func eventParameterIndex(f reflect.Method) int {
+	if takesContext(f) {
+		return 2
+	}
+	return 1
+}
+
+func takesContext(f reflect.Method) bool {
+	return f.Type.NumIn() > 2 && f.Type.In(1) == contextInterface
+}
+
+func takesEnvelope(f reflect.Method) bool {
+	return f.Type.NumIn() > 2 && f.Type.In(f.Type.NumIn()-1) == envelopeType
+}
@@ -1,6 +1,8 @@
 package components
 
 import (
+	"context"
+	"errors"
 	"github.com/davegarred/cqrs"
 	"reflect"
 	"testing"
@@ -8,14 +10,34 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+var errTestListener = errors.New("listener failed")
+
 func Test_hasEventListenerSignature(t *testing.T) {
 	eventListener, _ := reflect.TypeOf(&testMessageHandlerQueryEventListener{}).MethodByName("Handle")
 	commandHandler, _ := reflect.TypeOf(&testMessageHandlerAggregate{}).MethodByName("Handle")
 	aggregateEventListener, _ := reflect.TypeOf(&testMessageHandlerAggregate{}).MethodByName("HandleEvent")
+	envelopeEventListener, _ := reflect.TypeOf(&testMessageHandlerQueryEventListener{}).MethodByName("HandleWithEnvelope")
+	wrongSecondParam, _ := reflect.TypeOf(&testMessageHandlerQueryEventListener{}).MethodByName("HandleWithString")
 
 	assert.True(t, hasEventListenerSignature(eventListener))
 	assert.False(t, hasEventListenerSignature(commandHandler))
 	assert.True(t, hasEventListenerSignature(aggregateEventListener))
+	assert.True(t, hasEventListenerSignature(envelopeEventListener))
+	assert.False(t, hasEventListenerSignature(wrongSecondParam))
+}
+
+func Test_hasQueryEventListenerSignature(t *testing.T) {
+	eventListener, _ := reflect.TypeOf(&testMessageHandlerQueryEventListener{}).MethodByName("Handle")
+	failingListener, _ := reflect.TypeOf(&testMessageHandlerQueryEventListener{}).MethodByName("HandleWithError")
+	contextListener, _ := reflect.TypeOf(&testMessageHandlerQueryEventListener{}).MethodByName("HandleWithContext")
+	commandHandler, _ := reflect.TypeOf(&testMessageHandlerAggregate{}).MethodByName("Handle")
+
+	assert.True(t, hasQueryEventListenerSignature(eventListener))
+	assert.True(t, hasQueryEventListenerSignature(failingListener))
+	assert.True(t, hasQueryEventListenerSignature(contextListener))
+	assert.False(t, hasEventListenerSignature(contextListener))
+	assert.False(t, hasEventListenerSignature(failingListener))
+	assert.False(t, hasQueryEventListenerSignature(commandHandler))
 }
 
 func Test_hasCommandHandlerSignature(t *testing.T) {
@@ -23,9 +45,14 @@ func Test_hasCommandHandlerSignature(t *testing.T) {
 	commandHandler, _ := reflect.TypeOf(&testMessageHandlerAggregate{}).MethodByName("Handle")
 	aggregateEventListener, _ := reflect.TypeOf(&testMessageHandlerAggregate{}).MethodByName("HandleEvent")
 
+	contextCommandHandler, _ := reflect.TypeOf(&testMessageHandlerAggregate{}).MethodByName("HandleWithContext")
+	misplacedContext, _ := reflect.TypeOf(&testMessageHandlerAggregate{}).MethodByName("HandleWithMisplacedContext")
+
 	assert.True(t, hasCommandHandlerSignature(commandHandler))
 	assert.False(t, hasCommandHandlerSignature(eventListener))
 	assert.False(t, hasCommandHandlerSignature(aggregateEventListener))
+	assert.True(t, hasCommandHandlerSignature(contextCommandHandler))
+	assert.False(t, hasCommandHandlerSignature(misplacedContext))
 }
 
 func Test_queryEventListener_applyEvent(t *testing.T) {
@@ -33,30 +60,88 @@ func Test_queryEventListener_applyEvent(t *testing.T) {
 	method, _ := reflect.TypeOf(listener).MethodByName("Handle")
 	eventListener := NewEventListener(listener, method)
 
-	eventListener.applyEvent(testMessageHandlerEvent{})
+	eventListener.applyEvent(context.Background(), cqrs.NewEventEnvelope(testMessageHandlerEvent{}, cqrs.Metadata{}))
 
 	assert.True(t, listener.success)
 }
 
+func Test_queryEventListener_applyEventWithEnvelope(t *testing.T) {
+	listener := &testMessageHandlerQueryEventListener{}
+	method, _ := reflect.TypeOf(listener).MethodByName("HandleWithEnvelope")
+	eventListener := NewEventListener(listener, method)
+	envelope := cqrs.NewEventEnvelope(testMessageHandlerEvent{}, cqrs.Metadata{CorrelationId: "a_correlation_id"})
+
+	eventListener.applyEvent(context.Background(), envelope)
+
+	assert.Equal(t, envelope, listener.envelope)
+}
+
+func Test_queryEventListener_applyEventWithContext(t *testing.T) {
+	listener := &testMessageHandlerQueryEventListener{}
+	method, _ := reflect.TypeOf(listener).MethodByName("HandleWithContext")
+	eventListener := NewEventListener(listener, method)
+	ctx := context.WithValue(context.Background(), testContextKey{}, "a value")
+	envelope := cqrs.NewEventEnvelope(testMessageHandlerEvent{}, cqrs.Metadata{})
+
+	err := eventListener.applyEvent(ctx, envelope)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "a value", listener.contextValue)
+	assert.Equal(t, envelope, listener.envelope)
+}
+
+func Test_queryEventListener_applyEventError(t *testing.T) {
+	listener := &testMessageHandlerQueryEventListener{}
+	method, _ := reflect.TypeOf(listener).MethodByName("HandleWithError")
+	eventListener := NewEventListener(listener, method)
+
+	err := eventListener.applyEvent(context.Background(), cqrs.NewEventEnvelope(testMessageHandlerEvent{}, cqrs.Metadata{}))
+
+	assert.Equal(t, errTestListener, err)
+}
+
+func Test_queryEventListener_applyEventPanic(t *testing.T) {
+	listener := &testMessageHandlerQueryEventListener{}
+	method, _ := reflect.TypeOf(listener).MethodByName("HandleWithPanic")
+	eventListener := NewEventListener(listener, method)
+
+	err := eventListener.applyEvent(context.Background(), cqrs.NewEventEnvelope(testMessageHandlerEvent{}, cqrs.Metadata{}))
+
+	assert.True(t, errors.Is(err, ErrListenerPanicked))
+}
+
 func Test_aggregateMessageHandler_applyCommand(t *testing.T) {
 	aggregate := &testMessageHandlerAggregate{}
 	aggregateType := reflect.TypeOf(aggregate)
 	method, _ := aggregateType.MethodByName("Handle")
 	messageHandler := NewMessageHandler(aggregateType, method)
 
-	events, err := messageHandler.applyCommand(reflect.ValueOf(aggregate), testMessageHandlerCommand{})
+	events, err := messageHandler.applyCommand(context.Background(), reflect.ValueOf(aggregate), testMessageHandlerCommand{})
 
 	assert.Equal(t, []cqrs.Event{testMessageHandlerEvent{}}, events)
 	assert.Nil(t, err)
 }
 
+func Test_aggregateMessageHandler_applyCommandWithContext(t *testing.T) {
+	aggregate := &testMessageHandlerAggregate{}
+	aggregateType := reflect.TypeOf(aggregate)
+	method, _ := aggregateType.MethodByName("HandleWithContext")
+	messageHandler := NewMessageHandler(aggregateType, method)
+	ctx := context.WithValue(context.Background(), testContextKey{}, "a value")
+
+	_, err := messageHandler.applyCommand(ctx, reflect.ValueOf(aggregate), testMessageHandlerCommand{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "a value", aggregate.contextValue)
+}
+
 func Test_aggregateMessageHandler_applyEvent(t *testing.T) {
 	aggregate := &testMessageHandlerAggregate{}
 	aggregateType := reflect.TypeOf(aggregate)
 	method, _ := aggregateType.MethodByName("HandleEvent")
 	messageHandler := NewMessageHandler(aggregateType, method)
 
-	messageHandler.applyEvent(reflect.ValueOf(aggregate), testMessageHandlerEvent{})
+	messageHandler.applyEvent(reflect.ValueOf(aggregate), cqrs.NewEventEnvelope(testMessageHandlerEvent{}, cqrs.Metadata{}))
 
 	assert.True(t, aggregate.success)
 }
@@ -66,24 +151,53 @@ type testMessageHandlerEvent struct{}
 func (e testMessageHandlerEvent) AggregateId() string { return "" }
 
 type testMessageHandlerQueryEventListener struct {
-	success bool
+	success      bool
+	envelope     *cqrs.EventEnvelope
+	contextValue interface{}
 }
 
 func (l *testMessageHandlerQueryEventListener) Handle(e testMessageHandlerEvent) {
 	l.success = true
 }
+func (l *testMessageHandlerQueryEventListener) HandleWithEnvelope(e testMessageHandlerEvent, envelope *cqrs.EventEnvelope) {
+	l.envelope = envelope
+}
+func (l *testMessageHandlerQueryEventListener) HandleWithContext(ctx context.Context, e testMessageHandlerEvent, envelope *cqrs.EventEnvelope) error {
+	l.contextValue = ctx.Value(testContextKey{})
+	l.envelope = envelope
+	return nil
+}
+func (l *testMessageHandlerQueryEventListener) HandleWithError(e testMessageHandlerEvent) error {
+	return errTestListener
+}
+func (l *testMessageHandlerQueryEventListener) HandleWithPanic(e testMessageHandlerEvent) {
+	panic("a listener bug")
+}
+func (l *testMessageHandlerQueryEventListener) HandleWithString(e testMessageHandlerEvent, s string) {
+	panic("This should never be called")
+}
 
 type testMessageHandlerCommand struct{}
 
 func (e testMessageHandlerCommand) TargetAggregateId() string { return "" }
 
+type testContextKey struct{}
+
 type testMessageHandlerAggregate struct {
-	success bool
+	success      bool
+	contextValue interface{}
 }
 
 func (a *testMessageHandlerAggregate) Handle(e testMessageHandlerCommand) ([]cqrs.Event, error) {
 	return []cqrs.Event{testMessageHandlerEvent{}}, nil
 }
+func (a *testMessageHandlerAggregate) HandleWithContext(ctx context.Context, e testMessageHandlerCommand) ([]cqrs.Event, error) {
+	a.contextValue = ctx.Value(testContextKey{})
+	return nil, nil
+}
+func (a *testMessageHandlerAggregate) HandleWithMisplacedContext(e testMessageHandlerCommand, ctx context.Context) ([]cqrs.Event, error) {
+	panic("This should never be called")
+}
 func (a *testMessageHandlerAggregate) HandleEvent(e testMessageHandlerEvent) {
 	a.success = true
 }
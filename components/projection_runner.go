@@ -0,0 +1,190 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"sync"
+)
+
+var ErrRebuildInProgress = errors.New("projection is already being rebuilt")
+
+// ResettableProjection is a query listener whose read model can be cleared so that it can be rebuilt
+// from the event history.
+type ResettableProjection interface {
+	Reset(ctx context.Context) error
+}
+
+// ProjectionProgress reports how far a projection has replayed the event history. Target is the last
+// position in the store when the replay started; live events may have moved the store on since.
+type ProjectionProgress struct {
+	Name     string
+	Position int64
+	Target   int64
+	Done     bool
+}
+
+// ProjectionRunner keeps named query listeners fed from the event store and the event bus, and rebuilds
+// them from history on demand.
+type ProjectionRunner struct {
+	mu          sync.Mutex
+	eventStore  cqrs.EventStore
+	eventBus    Subscriber
+	projections map[string]*runningProjection
+	progress    func(ProjectionProgress)
+}
+
+type runningProjection struct {
+	listener     interface{}
+	subscription *CatchUpSubscription
+	rebuilding   bool
+}
+
+func NewProjectionRunner(eventStore cqrs.EventStore, eventBus Subscriber) *ProjectionRunner {
+	return &ProjectionRunner{
+		eventStore:  eventStore,
+		eventBus:    eventBus,
+		projections: make(map[string]*runningProjection),
+		progress:    func(ProjectionProgress) {},
+	}
+}
+
+// SetProgressReporter sets a function called after every page of history replayed and once more when
+// the replay is done.
+func (runner *ProjectionRunner) SetProgressReporter(report func(ProjectionProgress)) *ProjectionRunner {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	runner.progress = report
+	return runner
+}
+
+// Register replays the whole event history into the listener and then keeps it up to date with live
+// events.
+func (runner *ProjectionRunner) Register(ctx context.Context, name string, listener interface{}) error {
+	runner.mu.Lock()
+	if _, ok := runner.projections[name]; ok {
+		runner.mu.Unlock()
+		return fmt.Errorf("%w: projection %s is already registered", cqrs.ErrMisconfiguration, name)
+	}
+	projection := &runningProjection{listener: listener, rebuilding: true}
+	runner.projections[name] = projection
+	runner.mu.Unlock()
+
+	subscription, err := runner.replay(ctx, name, listener)
+
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if err != nil {
+		delete(runner.projections, name)
+		return err
+	}
+	projection.subscription, projection.rebuilding = subscription, false
+	return nil
+}
+
+// Projection returns the listener currently serving under the name, or nil.
+func (runner *ProjectionRunner) Projection(name string) interface{} {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if projection, ok := runner.projections[name]; ok {
+		return projection.listener
+	}
+	return nil
+}
+
+// Rebuild stops live delivery to the projection, resets it and replays the whole event history into it
+// before resuming live delivery. The read model is incomplete while this runs; see RebuildSideBySide.
+func (runner *ProjectionRunner) Rebuild(ctx context.Context, name string) error {
+	projection, err := runner.startRebuild(name)
+	if err != nil {
+		return err
+	}
+	resettable, ok := projection.listener.(ResettableProjection)
+	if !ok {
+		runner.finishRebuild(projection, projection.listener, projection.subscription)
+		return fmt.Errorf("%w: projection %s (%T) does not implement ResettableProjection", cqrs.ErrMisconfiguration, name, projection.listener)
+	}
+	projection.subscription.Close()
+	var subscription *CatchUpSubscription
+	if err = resettable.Reset(ctx); err == nil {
+		subscription, err = runner.replay(ctx, name, projection.listener)
+	}
+	if err != nil {
+		// leave the projection registered without live delivery, so that Rebuild can be retried
+		runner.finishRebuild(projection, projection.listener, projection.subscription)
+		return err
+	}
+	runner.finishRebuild(projection, projection.listener, subscription)
+	return nil
+}
+
+// RebuildSideBySide builds the replacement, a fresh instance of the projection, from the whole event
+// history while the current one keeps serving and receiving live events. Once the replacement has
+// caught up it takes over the name and the current one stops receiving events. If the replay fails the
+// current one stays in place.
+func (runner *ProjectionRunner) RebuildSideBySide(ctx context.Context, name string, replacement interface{}) error {
+	projection, err := runner.startRebuild(name)
+	if err != nil {
+		return err
+	}
+	subscription, err := runner.replay(ctx, name, replacement)
+	if err != nil {
+		runner.finishRebuild(projection, projection.listener, projection.subscription)
+		return err
+	}
+	projection.subscription.Close()
+	runner.finishRebuild(projection, replacement, subscription)
+	return nil
+}
+
+func (runner *ProjectionRunner) startRebuild(name string) (*runningProjection, error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	projection, ok := runner.projections[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: projection %s is not registered", cqrs.ErrMisconfiguration, name)
+	}
+	if projection.rebuilding {
+		return nil, fmt.Errorf("%w: %s", ErrRebuildInProgress, name)
+	}
+	projection.rebuilding = true
+	return projection, nil
+}
+
+func (runner *ProjectionRunner) finishRebuild(projection *runningProjection, listener interface{}, subscription *CatchUpSubscription) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	projection.listener, projection.subscription, projection.rebuilding = listener, subscription, false
+}
+
+// Close stops live delivery to every projection that is not being rebuilt.
+func (runner *ProjectionRunner) Close() {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	for name, projection := range runner.projections {
+		if !projection.rebuilding {
+			projection.subscription.Close()
+			delete(runner.projections, name)
+		}
+	}
+}
+
+func (runner *ProjectionRunner) replay(ctx context.Context, name string, listener interface{}) (*CatchUpSubscription, error) {
+	target, err := runner.eventStore.LastPosition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	runner.mu.Lock()
+	report := runner.progress
+	runner.mu.Unlock()
+	subscription := newCatchUpSubscription(runner.eventStore, 0, listener)
+	subscription.caughtUpTo = func(position int64) {
+		report(ProjectionProgress{Name: name, Position: position, Target: target})
+	}
+	if err := subscription.start(ctx, runner.eventBus); err != nil {
+		return nil, err
+	}
+	report(ProjectionProgress{Name: name, Position: subscription.Position(), Target: target, Done: true})
+	return subscription, nil
+}
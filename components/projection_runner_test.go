@@ -0,0 +1,119 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProjectionRunner_register(t *testing.T) {
+	assert := assert.New(t)
+	eventBus, eventStore := newProjectionTestStore(t, "first", "second")
+	var progress []ProjectionProgress
+	runner := NewProjectionRunner(eventStore, eventBus).SetProgressReporter(func(p ProjectionProgress) { progress = append(progress, p) })
+	defer runner.Close()
+	projection := newFooNameProjection()
+
+	assert.Nil(runner.Register(context.Background(), "names", projection))
+	assert.Nil(eventStore.Persist(context.Background(), fooId, 2, wrapEvents(fooNamedEvent{fooId, "third"})))
+
+	assert.Equal("third", projection.name(fooId))
+	assert.Equal([]ProjectionProgress{{"names", 2, 2, false}, {"names", 2, 2, true}}, progress)
+	assert.True(errors.Is(runner.Register(context.Background(), "names", projection), cqrs.ErrMisconfiguration))
+}
+
+func TestProjectionRunner_rebuild(t *testing.T) {
+	assert := assert.New(t)
+	eventBus, eventStore := newProjectionTestStore(t, "first", "second")
+	runner := NewProjectionRunner(eventStore, eventBus)
+	defer runner.Close()
+	projection := newFooNameProjection()
+	assert.Nil(runner.Register(context.Background(), "names", projection))
+	projection.names[fooId] = "corrupted"
+
+	assert.Nil(runner.Rebuild(context.Background(), "names"))
+	assert.Nil(eventStore.Persist(context.Background(), fooId, 2, wrapEvents(fooNamedEvent{fooId, "third"})))
+
+	assert.Equal("third", projection.name(fooId))
+	assert.Equal(1, projection.resets)
+	assert.Equal(3, projection.handled)
+}
+
+func TestProjectionRunner_rebuildNotResettable(t *testing.T) {
+	eventBus, eventStore := newProjectionTestStore(t, "first")
+	runner := NewProjectionRunner(eventStore, eventBus)
+	defer runner.Close()
+	assert.Nil(t, runner.Register(context.Background(), "positions", &positionListener{}))
+
+	err := runner.Rebuild(context.Background(), "positions")
+
+	assert.True(t, errors.Is(err, cqrs.ErrMisconfiguration))
+	assert.True(t, errors.Is(runner.Rebuild(context.Background(), "unknown"), cqrs.ErrMisconfiguration))
+}
+
+func TestProjectionRunner_rebuildSideBySide(t *testing.T) {
+	assert := assert.New(t)
+	eventBus, eventStore := newProjectionTestStore(t, "first", "second")
+	runner := NewProjectionRunner(eventStore, eventBus)
+	defer runner.Close()
+	current := newFooNameProjection()
+	assert.Nil(runner.Register(context.Background(), "names", current))
+	replacement := newFooNameProjection()
+
+	assert.Nil(runner.RebuildSideBySide(context.Background(), "names", replacement))
+	assert.Nil(eventStore.Persist(context.Background(), fooId, 2, wrapEvents(fooNamedEvent{fooId, "third"})))
+
+	assert.Equal(replacement, runner.Projection("names"))
+	assert.Equal("third", replacement.name(fooId))
+	assert.Equal("second", current.name(fooId))
+	assert.Equal(0, current.resets)
+}
+
+func newProjectionTestStore(t *testing.T, names ...string) (*SynchronousEventBus, cqrs.EventStore) {
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	for i, name := range names {
+		if err := eventStore.Persist(context.Background(), fooId, i, wrapEvents(fooNamedEvent{fooId, name})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return eventBus, eventStore
+}
+
+type fooNameProjection struct {
+	mu      sync.Mutex
+	names   map[string]string
+	handled int
+	resets  int
+}
+
+func newFooNameProjection() *fooNameProjection {
+	return &fooNameProjection{names: make(map[string]string)}
+}
+
+func (p *fooNameProjection) OnFooNamed(e fooNamedEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.names[e.Id] = e.Name
+	p.handled++
+}
+
+func (p *fooNameProjection) Reset(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.names = make(map[string]string)
+	p.handled = 0
+	p.resets++
+	return nil
+}
+
+func (p *fooNameProjection) name(id string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.names[id]
+}
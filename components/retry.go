@@ -0,0 +1,63 @@
+package components
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how often and how quickly a failed operation is attempted again. The zero
+// value performs a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt; each later delay is twice the previous one.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Jitter randomly shortens each delay by up to this fraction (0 to 1) to spread out competing retries.
+	Jitter float64
+}
+
+// RetryableCommand may be implemented by commands that must not be re-run after a concurrency
+// conflict, for instance because their handler has side effects outside of the event store.
+type RetryableCommand interface {
+	RetryOnConflict() bool
+}
+
+func (policy RetryPolicy) attempts() int {
+	if policy.MaxAttempts < 1 {
+		return 1
+	}
+	return policy.MaxAttempts
+}
+
+// backoff returns the delay after the given (1-based) failed attempt.
+func (policy RetryPolicy) backoff(attempt int, random func() float64) time.Duration {
+	delay := policy.InitialBackoff
+	for i := 1; i < attempt && (policy.MaxBackoff == 0 || delay < policy.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+		delay = policy.MaxBackoff
+	}
+	if policy.Jitter > 0 {
+		delay -= time.Duration(float64(delay) * policy.Jitter * random())
+	}
+	return delay
+}
+
+func (policy RetryPolicy) wait(ctx context.Context, attempt int) error {
+	delay := policy.backoff(attempt, rand.Float64)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
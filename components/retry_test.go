@@ -0,0 +1,105 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const counterId = "a_counter_id"
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	noJitter := func() float64 { return 0 }
+
+	assert.Equal(t, 10*time.Millisecond, policy.backoff(1, noJitter))
+	assert.Equal(t, 20*time.Millisecond, policy.backoff(2, noJitter))
+	assert.Equal(t, 40*time.Millisecond, policy.backoff(3, noJitter))
+	assert.Equal(t, 50*time.Millisecond, policy.backoff(4, noJitter))
+	assert.Equal(t, 50*time.Millisecond, policy.backoff(40, noJitter))
+
+	policy.Jitter = 0.5
+	assert.Equal(t, 15*time.Millisecond, policy.backoff(2, func() float64 { return 0.5 }))
+	assert.Equal(t, 1, RetryPolicy{}.attempts())
+}
+
+func TestCommandGateway_retriesConflicts(t *testing.T) {
+	commandGateway, eventStore := newRetryTestGateway(counterIncrementedEvent{Id: counterId}, counterIncrementedEvent{Id: counterId})
+	commandGateway.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5})
+
+	err := commandGateway.Dispatch(incrementCommand{Id: counterId})
+
+	assert.Nil(t, err)
+	events, _ := eventStore.Load(context.Background(), counterId)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, counterIncrementedEvent{counterId, 3}, events[2].Event)
+}
+
+func TestCommandGateway_retriesExhausted(t *testing.T) {
+	commandGateway, eventStore := newRetryTestGateway(counterIncrementedEvent{Id: counterId}, counterIncrementedEvent{Id: counterId}, counterIncrementedEvent{Id: counterId})
+	commandGateway.SetRetryPolicy(RetryPolicy{MaxAttempts: 2})
+
+	err := commandGateway.Dispatch(incrementCommand{Id: counterId})
+
+	assert.True(t, errors.Is(err, cqrs.ErrConcurrencyConflict))
+	events, _ := eventStore.Load(context.Background(), counterId)
+	assert.Equal(t, 2, len(events))
+}
+
+func TestCommandGateway_retryOptOut(t *testing.T) {
+	commandGateway, _ := newRetryTestGateway(counterIncrementedEvent{Id: counterId})
+	commandGateway.SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+
+	err := commandGateway.Dispatch(incrementCommand{Id: counterId, NoRetry: true})
+
+	assert.True(t, errors.Is(err, cqrs.ErrConcurrencyConflict))
+}
+
+func TestCommandGateway_retryCancelledDuringBackoff(t *testing.T) {
+	commandGateway, _ := newRetryTestGateway(counterIncrementedEvent{Id: counterId})
+	commandGateway.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := commandGateway.DispatchContext(ctx, incrementCommand{Id: counterId})
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func newRetryTestGateway(competingEvents ...cqrs.Event) (*CommandGateway, cqrs.EventStore) {
+	eventStore := &racingEventStore{EventStore: persist.NewMemEventStore(NewEventBus()), interleave: competingEvents}
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&counterAggregate{})
+	return commandGateway, eventStore
+}
+
+type counterAggregate struct {
+	count int
+}
+
+func (a *counterAggregate) HandleIncrement(c incrementCommand) ([]cqrs.Event, error) {
+	return []cqrs.Event{counterIncrementedEvent{c.Id, a.count + 1}}, nil
+}
+func (a *counterAggregate) OnIncremented(e counterIncrementedEvent) {
+	a.count++
+}
+
+type incrementCommand struct {
+	Id      string
+	NoRetry bool
+}
+
+func (c incrementCommand) TargetAggregateId() string { return c.Id }
+func (c incrementCommand) RetryOnConflict() bool     { return !c.NoRetry }
+
+type counterIncrementedEvent struct {
+	Id    string
+	Count int
+}
+
+func (e counterIncrementedEvent) AggregateId() string { return e.Id }
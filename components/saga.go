@@ -0,0 +1,334 @@
+package components
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	commandSliceType       = reflect.TypeOf([]cqrs.Command{})
+	sagaLifecycleInterface = reflect.TypeOf((*sagaLifecycle)(nil)).Elem()
+)
+
+// CommandDispatcher is implemented by CommandGateway.
+type CommandDispatcher interface {
+	DispatchContext(ctx context.Context, command cqrs.Command) error
+}
+
+// SagaLifecycle must be embedded in every saga type. Its state is kept by the SagaManager alongside the
+// saga's exported fields, which are persisted as JSON.
+type SagaLifecycle struct {
+	ended        bool
+	associations []string
+}
+
+// End ends the saga once the current handler returns; its state is then deleted.
+func (lifecycle *SagaLifecycle) End() {
+	lifecycle.ended = true
+}
+
+// AssociateWith makes events carrying the value reach the saga, in addition to the value it was started with.
+func (lifecycle *SagaLifecycle) AssociateWith(value string) {
+	for _, association := range lifecycle.associations {
+		if association == value {
+			return
+		}
+	}
+	lifecycle.associations = append(lifecycle.associations, value)
+}
+
+func (lifecycle *SagaLifecycle) sagaLifecycle() *SagaLifecycle {
+	return lifecycle
+}
+
+type sagaLifecycle interface {
+	sagaLifecycle() *SagaLifecycle
+}
+
+// SagaAssociation may be implemented by saga types to name the string field of their events that ties
+// the events to a saga instance. Without it, or for events lacking the field, the event's aggregate ID
+// is used.
+type SagaAssociation interface {
+	AssociationProperty() string
+}
+
+type sagaHandler struct {
+	SagaType    reflect.Type
+	FuncName    string
+	F           reflect.Value
+	Starts      bool
+	WithContext bool
+	Property    string
+}
+
+// SagaManager runs long-lived workflows that react to events by issuing commands. Saga types are
+// discovered by reflection: methods taking an event, optionally preceded by a context.Context, and
+// returning `([]cqrs.Command, error)` handle events, and those whose name starts with "Start" create a new
+// instance when no instance is associated with the event yet. The manager is itself a query listener and
+// must be registered with an event bus or a tracking processor.
+type SagaManager struct {
+	mu         sync.RWMutex
+	dispatcher CommandDispatcher
+	sagaStore  cqrs.SagaStore
+	handlers   map[reflect.Type][]*sagaHandler
+	locks      *aggregateLocks
+	scheduler  *Scheduler
+}
+
+func NewSagaManager(dispatcher CommandDispatcher, sagaStore cqrs.SagaStore) *SagaManager {
+	return &SagaManager{
+		dispatcher: dispatcher,
+		sagaStore:  sagaStore,
+		handlers:   make(map[reflect.Type][]*sagaHandler),
+		locks:      newAggregateLocks(),
+	}
+}
+
+func (manager *SagaManager) RegisterSaga(saga interface{}) error {
+	sagaType := reflect.TypeOf(saga)
+	if sagaType.Kind() != reflect.Ptr || !sagaType.Implements(sagaLifecycleInterface) {
+		return fmt.Errorf("%w: saga %v must be a pointer to a struct embedding components.SagaLifecycle", cqrs.ErrMisconfiguration, sagaType)
+	}
+	property := ""
+	if association, ok := saga.(SagaAssociation); ok {
+		property = association.AssociationProperty()
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	for i := 0; i < sagaType.NumMethod(); i++ {
+		f := sagaType.Method(i)
+
+		if hasSagaHandlerSignature(f) {
+			eventType := eventParameter(f)
+			manager.handlers[eventType] = append(manager.handlers[eventType], &sagaHandler{
+				SagaType:    sagaType,
+				FuncName:    f.Name,
+				F:           f.Func,
+				Starts:      strings.HasPrefix(f.Name, "Start"),
+				WithContext: takesContext(f),
+				Property:    property,
+			})
+		}
+	}
+	return nil
+}
+
+// SagaTypeName returns the name the SagaManager stores the saga's instances under, as their
+// cqrs.SagaState.SagaType.
+func SagaTypeName(saga interface{}) string {
+	return aggregateTypeName(reflect.TypeOf(saga))
+}
+
+// SetScheduler makes the scheduler available to saga handlers taking a context.Context, for deadlines
+// such as cancelling an order that is not paid in time.
+func (manager *SagaManager) SetScheduler(scheduler *Scheduler) *SagaManager {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.scheduler = scheduler
+	return manager
+}
+
+// HandleEvent passes the event to every saga instance associated with it and then dispatches the commands
+// they issue, caused by the event and in its correlation. Saga state is saved before the commands are
+// dispatched, so a failed command is reported but not rolled back: when the event is delivered again, by
+// an event bus retry or a dead-letter replay, the handlers run again on state that already reflects it.
+// Handlers that may see such a redelivery should issue the same commands again without counting the
+// event twice, for instance by keeping the IDs of the entities they act on rather than counters.
+//
+// When the event is published synchronously by a CommandGateway dispatch, the commands are instead
+// dispatched once that dispatch has released its aggregate lock, and their errors are returned by it.
+func (manager *SagaManager) HandleEvent(ctx context.Context, event cqrs.Event, envelope *cqrs.EventEnvelope) error {
+	manager.mu.RLock()
+	handlers := manager.handlers[reflect.TypeOf(event)]
+	scheduler := manager.scheduler
+	manager.mu.RUnlock()
+	if scheduler != nil {
+		ctx = ContextWithScheduler(ctx, scheduler)
+	}
+	ctx = cqrs.ContextWithMetadata(ctx, cqrs.Metadata{CausationId: envelope.EventId, CorrelationId: envelope.CorrelationId, Headers: envelope.Headers})
+	for _, handler := range handlers {
+		commands, err := manager.handle(ctx, handler, envelope)
+		if err != nil {
+			return err
+		}
+		for _, command := range commands {
+			if deferred := deferredCommandsFromContext(ctx); deferred != nil && deferred.add(ctx, manager.dispatcher, command) {
+				continue
+			}
+			if err := manager.dispatcher.DispatchContext(ctx, command); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (manager *SagaManager) handle(ctx context.Context, handler *sagaHandler, envelope *cqrs.EventEnvelope) ([]cqrs.Command, error) {
+	sagaType := aggregateTypeName(handler.SagaType)
+	association := associationValue(envelope.Event, handler.Property)
+	key := sagaType + "\x00" + association
+	manager.locks.lock(key)
+	defer manager.locks.unlock(key)
+
+	states, err := manager.sagaStore.FindSagas(ctx, sagaType, association)
+	if err != nil {
+		return nil, err
+	}
+	existing := len(states) > 0
+	if !existing && handler.Starts {
+		states = []cqrs.SagaState{{SagaId: cqrs.NewId(), SagaType: sagaType, Associations: []string{association}}}
+	}
+	var commands []cqrs.Command
+	for _, state := range states {
+		issued, err := manager.apply(ctx, handler, state, existing, association, envelope)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, issued...)
+	}
+	return commands, nil
+}
+
+// apply runs the handler on a saga instance under the instance's lock. The state found through the
+// association may be stale by then, as events reaching the instance through its other associations are
+// handled under other association locks, so an existing instance is reloaded once locked.
+func (manager *SagaManager) apply(ctx context.Context, handler *sagaHandler, state cqrs.SagaState, existing bool, association string, envelope *cqrs.EventEnvelope) ([]cqrs.Command, error) {
+	manager.locks.lock(state.SagaId)
+	defer manager.locks.unlock(state.SagaId)
+
+	if existing {
+		current, ok, err := manager.reload(ctx, state, association)
+		if err != nil || !ok {
+			return nil, err
+		}
+		state = current
+	}
+	saga := reflect.New(handler.SagaType.Elem())
+	if len(state.Payload) > 0 {
+		if err := json.Unmarshal(state.Payload, saga.Interface()); err != nil {
+			return nil, fmt.Errorf("%w: saga %s: %v", cqrs.ErrSerialization, state.SagaId, err)
+		}
+	}
+	lifecycle := saga.Interface().(sagaLifecycle).sagaLifecycle()
+	lifecycle.associations = append([]string{}, state.Associations...)
+
+	in := []reflect.Value{saga, reflect.ValueOf(envelope.Event)}
+	if handler.WithContext {
+		in = []reflect.Value{saga, reflect.ValueOf(ctx), reflect.ValueOf(envelope.Event)}
+	}
+	response := handler.F.Call(in)
+	if err := response[1].Interface(); err != nil {
+		return nil, err.(error)
+	}
+	commands := response[0].Interface().([]cqrs.Command)
+
+	if lifecycle.ended {
+		return commands, manager.sagaStore.DeleteSaga(ctx, state.SagaType, state.SagaId)
+	}
+	payload, err := json.Marshal(saga.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("%w: saga %s: %v", cqrs.ErrSerialization, state.SagaId, err)
+	}
+	state.Associations, state.Payload = lifecycle.associations, payload
+	return commands, manager.sagaStore.SaveSaga(ctx, state)
+}
+
+// reload returns the current state of the saga instance, or false if it has ended or no longer carries
+// the association since it was found.
+func (manager *SagaManager) reload(ctx context.Context, state cqrs.SagaState, association string) (cqrs.SagaState, bool, error) {
+	states, err := manager.sagaStore.FindSagas(ctx, state.SagaType, association)
+	if err != nil {
+		return state, false, err
+	}
+	for _, current := range states {
+		if current.SagaId == state.SagaId {
+			return current, true, nil
+		}
+	}
+	return state, false, nil
+}
+
+// hasSagaHandlerSignature matches both `On(e SomeEvent) ([]cqrs.Command, error)` and
+// `On(ctx context.Context, e SomeEvent) ([]cqrs.Command, error)`.
+func hasSagaHandlerSignature(f reflect.Method) bool {
+	if f.Type.NumOut() != 2 || f.Type.Out(0) != commandSliceType || f.Type.Out(1) != errorInterface {
+		return false
+	}
+	return f.Type.NumIn() == eventParameterIndex(f)+1 && eventParameter(f).Implements(eventInterface)
+}
+
+func associationValue(event cqrs.Event, property string) string {
+	if property != "" {
+		value := reflect.Indirect(reflect.ValueOf(event))
+		if value.Kind() == reflect.Struct {
+			if field := value.FieldByName(property); field.IsValid() && field.Kind() == reflect.String {
+				return field.String()
+			}
+		}
+	}
+	return event.AggregateId()
+}
+
+type deferredCommandsKey struct{}
+
+// deferredCommands holds the commands sagas issue while reacting synchronously to the events of a
+// dispatch. Dispatching them right away would wait for another aggregate's lock while holding the lock of
+// the dispatch, and two dispatches doing so in opposite directions would wait for each other forever.
+type deferredCommands struct {
+	mu       sync.Mutex
+	drained  bool
+	commands []deferredCommand
+}
+
+type deferredCommand struct {
+	ctx        context.Context
+	dispatcher CommandDispatcher
+	command    cqrs.Command
+}
+
+func contextWithDeferredCommands(ctx context.Context, deferred *deferredCommands) context.Context {
+	return context.WithValue(ctx, deferredCommandsKey{}, deferred)
+}
+
+func deferredCommandsFromContext(ctx context.Context) *deferredCommands {
+	deferred, _ := ctx.Value(deferredCommandsKey{}).(*deferredCommands)
+	return deferred
+}
+
+// add queues the command for dispatch with ctx, unless the queue has already been drained.
+func (deferred *deferredCommands) add(ctx context.Context, dispatcher CommandDispatcher, command cqrs.Command) bool {
+	deferred.mu.Lock()
+	defer deferred.mu.Unlock()
+	if deferred.drained {
+		return false
+	}
+	deferred.commands = append(deferred.commands, deferredCommand{ctx, dispatcher, command})
+	return true
+}
+
+// dispatch dispatches the queued commands in order, along with those they cause to be queued, and returns
+// their errors together.
+func (deferred *deferredCommands) dispatch() error {
+	var errs []error
+	for {
+		deferred.mu.Lock()
+		if len(deferred.commands) == 0 {
+			deferred.drained = true
+			deferred.mu.Unlock()
+			return errors.Join(errs...)
+		}
+		next := deferred.commands[0]
+		deferred.commands = deferred.commands[1:]
+		deferred.mu.Unlock()
+		if err := next.dispatcher.DispatchContext(next.ctx, next.command); err != nil {
+			errs = append(errs, err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSagaManager_startDispatchAndEnd(t *testing.T) {
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	sagaStore := persist.NewMemSagaStore()
+	sagaManager := NewSagaManager(commandGateway, sagaStore)
+	assert.Nil(t, sagaManager.RegisterSaga(&fooNamingSaga{}))
+	eventBus.RegisterQueryEventHandlers(sagaManager)
+
+	assert.Nil(t, commandGateway.Dispatch(createFoo))
+
+	// the saga named the foo from within the dispatch that created it, and ended once it was named
+	events, err := eventStore.Load(context.Background(), fooId)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, fooNamedEvent{fooId, "named by a saga"}, events[1].Event)
+	assert.Equal(t, events[0].EventId, events[1].CausationId)
+	assert.Equal(t, events[0].CorrelationId, events[1].CorrelationId)
+	states, _ := sagaStore.FindSagas(context.Background(), SagaTypeName(&fooNamingSaga{}), fooId)
+	assert.Equal(t, 0, len(states))
+}
+
+func TestSagaManager_correlatesByProperty(t *testing.T) {
+	dispatcher := &recordingDispatcher{}
+	sagaStore := persist.NewMemSagaStore()
+	sagaManager := NewSagaManager(dispatcher, sagaStore)
+	assert.Nil(t, sagaManager.RegisterSaga(&barConfigurationSaga{}))
+	ctx := context.Background()
+	handle := func(e cqrs.Event) error {
+		return sagaManager.HandleEvent(ctx, e, cqrs.NewEventEnvelope(e, cqrs.Metadata{}))
+	}
+
+	// without a running saga, events that do not start one are ignored
+	assert.Nil(t, handle(barConfiguredEvent{barId, "a configuration"}))
+	assert.Nil(t, handle(barCreatedEvent{barId}))
+	assert.Nil(t, handle(barConfiguredEvent{"another_bar_id", "ignored"}))
+	assert.Nil(t, handle(barConfiguredEvent{barId, "a configuration"}))
+	assert.Nil(t, handle(barConfiguredEvent{barId, "a second configuration"}))
+	// reaches the saga through the association added by the saga itself
+	assert.Nil(t, handle(fooLinkedEvent{"another_bar_id", "foo-for-a configuration"}))
+	assert.Nil(t, handle(fooLinkedEvent{barId, "an unknown foo"}))
+
+	assert.Equal(t, []cqrs.Command{createFooCommand{"foo-for-a configuration"}}, dispatcher.commands)
+	states, err := sagaStore.FindSagas(ctx, SagaTypeName(&barConfigurationSaga{}), barId)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(states))
+	assert.Equal(t, []string{barId, "foo-for-a configuration"}, states[0].Associations)
+	assert.JSONEq(t, `{"Configurations":2,"Links":1}`, string(states[0].Payload))
+}
+
+func TestSagaManager_handlerError(t *testing.T) {
+	sagaManager := NewSagaManager(&recordingDispatcher{}, persist.NewMemSagaStore())
+	assert.Nil(t, sagaManager.RegisterSaga(&barConfigurationSaga{}))
+	e := barCreatedEvent{""}
+
+	err := sagaManager.HandleEvent(context.Background(), e, cqrs.NewEventEnvelope(e, cqrs.Metadata{}))
+
+	assert.Equal(t, errMissingBarId, err)
+}
+
+func TestSagaManager_registerWithoutLifecycle(t *testing.T) {
+	sagaManager := NewSagaManager(&recordingDispatcher{}, persist.NewMemSagaStore())
+
+	err := sagaManager.RegisterSaga(&fooBarEventListener{})
+
+	assert.True(t, errors.Is(err, cqrs.ErrMisconfiguration))
+}
+
+func TestSagaManager_concurrentEventsThroughSeveralAssociations(t *testing.T) {
+	sagaStore := persist.NewMemSagaStore()
+	sagaManager := NewSagaManager(&recordingDispatcher{}, sagaStore)
+	assert.Nil(t, sagaManager.RegisterSaga(&countingSaga{}))
+	ctx := context.Background()
+	handle := func(e cqrs.Event) error {
+		return sagaManager.HandleEvent(ctx, e, cqrs.NewEventEnvelope(e, cqrs.Metadata{}))
+	}
+	assert.Nil(t, handle(barCreatedEvent{barId}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		association := barId
+		if i%2 == 1 {
+			association = "another_" + barId
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, handle(barConfiguredEvent{association, "a configuration"}))
+		}()
+	}
+	wg.Wait()
+
+	states, err := sagaStore.FindSagas(ctx, SagaTypeName(&countingSaga{}), barId)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"Count":100}`, string(states[0].Payload))
+}
+
+func TestSagaManager_concurrentCrossAggregateChains(t *testing.T) {
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&relayAggregate{})
+	sagaManager := NewSagaManager(commandGateway, persist.NewMemSagaStore())
+	assert.Nil(t, sagaManager.RegisterSaga(&relaySaga{}))
+	eventBus.RegisterQueryEventHandlers(sagaManager)
+	const hops = 10
+
+	// each chain bounces between the two aggregates, starting from opposite ends once both hold the lock of
+	// their first aggregate
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	dispatched := make(chan error)
+	go func() { dispatched <- commandGateway.Dispatch(relayCommand{"relay_a", "relay_b", hops, &arrived}) }()
+	go func() { dispatched <- commandGateway.Dispatch(relayCommand{"relay_b", "relay_a", hops, &arrived}) }()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-dispatched:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("saga chains deadlocked")
+		}
+	}
+
+	for _, id := range []string{"relay_a", "relay_b"} {
+		events, err := eventStore.Load(context.Background(), id)
+		assert.Nil(t, err)
+		assert.Equal(t, hops+1, len(events))
+	}
+}
+
+func Test_hasSagaHandlerSignature(t *testing.T) {
+	sagaType := reflect.TypeOf(&barConfigurationSaga{})
+	startHandler, _ := sagaType.MethodByName("StartOnBarCreated")
+	contextHandler, _ := sagaType.MethodByName("OnBarConfigured")
+	end, _ := sagaType.MethodByName("End")
+	queryListener, _ := reflect.TypeOf(&fooBarEventListener{}).MethodByName("OnFooCreated")
+
+	assert.True(t, hasSagaHandlerSignature(startHandler))
+	assert.True(t, hasSagaHandlerSignature(contextHandler))
+	assert.False(t, hasSagaHandlerSignature(end))
+	assert.False(t, hasSagaHandlerSignature(queryListener))
+}
+
+var errMissingBarId = errors.New("bar ID is missing")
+
+type fooNamingSaga struct {
+	SagaLifecycle
+	FooId string
+}
+
+func (s *fooNamingSaga) StartOnFooCreated(e fooCreatedEvent) ([]cqrs.Command, error) {
+	s.FooId = e.Id
+	return []cqrs.Command{nameFooCommand{e.Id, "named by a saga"}}, nil
+}
+func (s *fooNamingSaga) OnFooNamed(e fooNamedEvent) ([]cqrs.Command, error) {
+	s.End()
+	return nil, nil
+}
+
+// barConfigurationSaga creates a foo for the first configuration of a bar and then follows the bar's
+// configurations through the foo's ID.
+type barConfigurationSaga struct {
+	SagaLifecycle
+	Configurations int
+	Links          int
+}
+
+func (s *barConfigurationSaga) AssociationProperty() string { return "FooId" }
+
+func (s *barConfigurationSaga) StartOnBarCreated(e barCreatedEvent) ([]cqrs.Command, error) {
+	if e.Id == "" {
+		return nil, errMissingBarId
+	}
+	return nil, nil
+}
+func (s *barConfigurationSaga) OnBarConfigured(ctx context.Context, e barConfiguredEvent) ([]cqrs.Command, error) {
+	s.Configurations++
+	if s.Configurations > 1 {
+		return nil, nil
+	}
+	fooId := "foo-for-" + e.Configuration
+	s.AssociateWith(fooId)
+	return []cqrs.Command{createFooCommand{fooId}}, nil
+}
+
+func (s *barConfigurationSaga) OnFooLinked(e fooLinkedEvent) ([]cqrs.Command, error) {
+	s.Links++
+	return nil, nil
+}
+
+// countingSaga counts the configurations of a bar, which reach it through either of its associations.
+type countingSaga struct {
+	SagaLifecycle
+	Count int
+}
+
+func (s *countingSaga) StartOnBarCreated(e barCreatedEvent) ([]cqrs.Command, error) {
+	s.AssociateWith("another_" + e.Id)
+	return nil, nil
+}
+func (s *countingSaga) OnBarConfigured(e barConfiguredEvent) ([]cqrs.Command, error) {
+	s.Count++
+	return nil, nil
+}
+
+// relaySaga passes every relayed event on to the aggregate it names, until the hops run out.
+type relaySaga struct {
+	SagaLifecycle
+}
+
+func (s *relaySaga) StartOnRelayed(e relayedEvent) ([]cqrs.Command, error) {
+	s.End()
+	if e.Hops == 0 {
+		return nil, nil
+	}
+	return []cqrs.Command{relayCommand{e.Target, e.Id, e.Hops - 1, nil}}, nil
+}
+
+type relayAggregate struct{}
+
+func (a *relayAggregate) HandleRelay(c relayCommand) ([]cqrs.Event, error) {
+	if c.arrived != nil {
+		c.arrived.Done()
+		c.arrived.Wait()
+	}
+	return []cqrs.Event{relayedEvent{c.Id, c.Target, c.Hops}}, nil
+}
+
+type relayCommand struct {
+	Id      string
+	Target  string
+	Hops    int
+	arrived *sync.WaitGroup
+}
+
+func (c relayCommand) TargetAggregateId() string { return c.Id }
+
+type relayedEvent struct {
+	Id     string
+	Target string
+	Hops   int
+}
+
+func (e relayedEvent) AggregateId() string { return e.Id }
+
+type fooLinkedEvent struct {
+	BarId string
+	FooId string
+}
+
+func (e fooLinkedEvent) AggregateId() string { return e.BarId }
+
+type recordingDispatcher struct {
+	commands []cqrs.Command
+}
+
+func (d *recordingDispatcher) DispatchContext(ctx context.Context, command cqrs.Command) error {
+	d.commands = append(d.commands, command)
+	return nil
+}
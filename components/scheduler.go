@@ -0,0 +1,207 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"sync"
+	"time"
+)
+
+const defaultPollInterval = time.Second
+
+type schedulerKey struct{}
+
+type pendingSchedulesKey struct{}
+
+type dispatchOutcomeKey struct{}
+
+// dispatchOutcome is filled in by a CommandGateway dispatching a scheduled command, telling failures the
+// command handler is responsible for from those of the infrastructure around it.
+type dispatchOutcome struct {
+	// rejected is set when the command handler returned an error.
+	rejected bool
+	// persisted is set once the events the command handler returned have been persisted.
+	persisted bool
+}
+
+// ContextWithScheduler makes the scheduler available to the handlers run with the context. The
+// CommandGateway and the SagaManager do this for the scheduler set on them.
+func ContextWithScheduler(ctx context.Context, scheduler *Scheduler) context.Context {
+	return context.WithValue(ctx, schedulerKey{}, scheduler)
+}
+
+// SchedulerFromContext returns the scheduler attached to the context, or nil.
+func SchedulerFromContext(ctx context.Context) *Scheduler {
+	scheduler, _ := ctx.Value(schedulerKey{}).(*Scheduler)
+	return scheduler
+}
+
+// Scheduler dispatches commands and publishes deadline events once they fall due. Scheduled messages are
+// kept in a cqrs.ScheduleStore until they have been delivered, so a durable store carries them across
+// restarts; a message may therefore be delivered again if the process stops while delivering it.
+//
+// Messages scheduled or cancelled by a command handler take effect once the events the handler returns
+// have been persisted: they are discarded when the command fails, and a handler run again after a
+// concurrency conflict schedules them afresh.
+type Scheduler struct {
+	store        cqrs.ScheduleStore
+	clock        cqrs.Clock
+	dispatcher   CommandDispatcher
+	eventBus     cqrs.EventBus
+	firing       sync.Mutex
+	mu           sync.RWMutex
+	pollInterval time.Duration
+}
+
+func NewScheduler(store cqrs.ScheduleStore, clock cqrs.Clock, dispatcher CommandDispatcher, eventBus cqrs.EventBus) *Scheduler {
+	return &Scheduler{
+		store:        store,
+		clock:        clock,
+		dispatcher:   dispatcher,
+		eventBus:     eventBus,
+		pollInterval: defaultPollInterval,
+	}
+}
+
+// SetPollInterval sets how often Run looks for messages that have fallen due.
+func (scheduler *Scheduler) SetPollInterval(interval time.Duration) *Scheduler {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	scheduler.pollInterval = interval
+	return scheduler
+}
+
+// Clock returns the clock deadlines are measured against.
+func (scheduler *Scheduler) Clock() cqrs.Clock {
+	return scheduler.clock
+}
+
+// ScheduleCommand schedules the command for dispatch at the given time and returns the ID to cancel it
+// with. The metadata attached to ctx is used for the dispatch.
+func (scheduler *Scheduler) ScheduleCommand(ctx context.Context, at time.Time, command cqrs.Command) (string, error) {
+	return scheduler.schedule(ctx, cqrs.ScheduledMessage{Due: at, Command: command})
+}
+
+// ScheduleEvent schedules a deadline event for publishing on the event bus at the given time and returns
+// the ID to cancel it with. Deadline events are not persisted to the event store, so they carry no
+// position: catch-up subscriptions deliver them as they are published, and never replay them.
+func (scheduler *Scheduler) ScheduleEvent(ctx context.Context, at time.Time, event cqrs.Event) (string, error) {
+	return scheduler.schedule(ctx, cqrs.ScheduledMessage{Due: at, Event: event})
+}
+
+func (scheduler *Scheduler) schedule(ctx context.Context, message cqrs.ScheduledMessage) (string, error) {
+	message.ScheduleId = cqrs.NewId()
+	message.Metadata = cqrs.MetadataFromContext(ctx)
+	if pending := pendingSchedulesFromContext(ctx); pending != nil {
+		pending.add(func(ctx context.Context) error { return scheduler.store.SaveSchedule(ctx, message) })
+		return message.ScheduleId, nil
+	}
+	if err := scheduler.store.SaveSchedule(ctx, message); err != nil {
+		return "", err
+	}
+	return message.ScheduleId, nil
+}
+
+// Cancel drops a scheduled message. Cancelling a message that was already delivered or cancelled does
+// nothing.
+func (scheduler *Scheduler) Cancel(ctx context.Context, scheduleId string) error {
+	if pending := pendingSchedulesFromContext(ctx); pending != nil {
+		pending.add(func(ctx context.Context) error { return scheduler.store.DeleteSchedule(ctx, scheduleId) })
+		return nil
+	}
+	return scheduler.store.DeleteSchedule(ctx, scheduleId)
+}
+
+// FireDue delivers every message due by now, earliest first, and returns how many it delivered. A
+// message is removed once delivered, or once the handler of its command has rejected it or returned
+// events that were persisted. After any other failure, such as a concurrency conflict, a command without a
+// handler or an unavailable store, it is kept for the next call. Messages the store cannot read are
+// skipped. All errors are returned together.
+func (scheduler *Scheduler) FireDue(ctx context.Context) (int, error) {
+	scheduler.firing.Lock()
+	defer scheduler.firing.Unlock()
+	var errs []error
+	due, err := scheduler.store.DueSchedules(ctx, scheduler.clock.Now())
+	if err != nil {
+		errs = append(errs, err)
+	}
+	delivered := 0
+	for _, message := range due {
+		outcome, err := scheduler.deliver(ctx, message)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if err == nil || outcome.persisted {
+			delivered++
+		} else if !outcome.rejected {
+			continue
+		}
+		if err := scheduler.store.DeleteSchedule(ctx, message.ScheduleId); err != nil {
+			return delivered, errors.Join(append(errs, err)...)
+		}
+	}
+	return delivered, errors.Join(errs...)
+}
+
+func (scheduler *Scheduler) deliver(ctx context.Context, message cqrs.ScheduledMessage) (*dispatchOutcome, error) {
+	ctx = ContextWithScheduler(cqrs.ContextWithMetadata(ctx, message.Metadata), scheduler)
+	outcome := &dispatchOutcome{}
+	if message.Command != nil {
+		return outcome, scheduler.dispatcher.DispatchContext(context.WithValue(ctx, dispatchOutcomeKey{}, outcome), message.Command)
+	}
+	return outcome, scheduler.eventBus.PublishEvents(ctx, []*cqrs.EventEnvelope{cqrs.NewEventEnvelope(message.Event, message.Metadata)})
+}
+
+// Run fires due messages every poll interval until ctx is done. Errors of individual messages do not stop
+// it; they are reported to onError, which may be nil.
+func (scheduler *Scheduler) Run(ctx context.Context, onError func(error)) error {
+	for {
+		if _, err := scheduler.FireDue(ctx); err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+		scheduler.mu.RLock()
+		interval := scheduler.pollInterval
+		scheduler.mu.RUnlock()
+		select {
+		case <-scheduler.clock.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pendingSchedules holds the schedule store writes made by a command handler until the events it returned
+// have been persisted.
+type pendingSchedules struct {
+	mu     sync.Mutex
+	writes []func(ctx context.Context) error
+}
+
+func contextWithPendingSchedules(ctx context.Context, pending *pendingSchedules) context.Context {
+	return context.WithValue(ctx, pendingSchedulesKey{}, pending)
+}
+
+func pendingSchedulesFromContext(ctx context.Context) *pendingSchedules {
+	pending, _ := ctx.Value(pendingSchedulesKey{}).(*pendingSchedules)
+	return pending
+}
+
+func (pending *pendingSchedules) add(write func(ctx context.Context) error) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	pending.writes = append(pending.writes, write)
+}
+
+// commit makes the writes in the order they were made, stopping at the first that fails.
+func (pending *pendingSchedules) commit(ctx context.Context) error {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	for _, write := range pending.writes {
+		if err := write(ctx); err != nil {
+			return err
+		}
+	}
+	pending.writes = nil
+	return nil
+}
@@ -0,0 +1,331 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const paymentPeriod = 3 * 24 * time.Hour
+
+var schedulerEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func newSchedulerTest(store cqrs.ScheduleStore) (*Scheduler, *FakeClock, *CommandGateway, cqrs.EventStore) {
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&barAggregate{})
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	clock := NewFakeClock(schedulerEpoch)
+	scheduler := NewScheduler(store, clock, commandGateway, eventBus)
+	commandGateway.SetScheduler(scheduler)
+	sagaManager := NewSagaManager(commandGateway, persist.NewMemSagaStore()).SetScheduler(scheduler)
+	sagaManager.RegisterSaga(&barPaymentSaga{})
+	eventBus.RegisterQueryEventHandlers(sagaManager)
+	return scheduler, clock, commandGateway, eventStore
+}
+
+func TestScheduler_deadlineExpires(t *testing.T) {
+	assert := assert.New(t)
+	scheduler, clock, commandGateway, eventStore := newSchedulerTest(persist.NewMemScheduleStore())
+	ctx := context.Background()
+	assert.Nil(commandGateway.Dispatch(createBar))
+
+	clock.Advance(paymentPeriod - time.Second)
+	delivered, err := scheduler.FireDue(ctx)
+	assert.Nil(err)
+	assert.Equal(0, delivered)
+
+	clock.Advance(time.Second)
+	delivered, err = scheduler.FireDue(ctx)
+	assert.Nil(err)
+	assert.Equal(1, delivered)
+
+	events, _ := eventStore.Load(ctx, barId)
+	assert.Equal(2, len(events))
+	assert.Equal(barConfiguredEvent{barId, "expired"}, events[1].Event)
+	assert.Equal(events[0].CorrelationId, events[1].CorrelationId)
+	delivered, _ = scheduler.FireDue(ctx)
+	assert.Equal(0, delivered)
+}
+
+func TestScheduler_deadlineCancelled(t *testing.T) {
+	assert := assert.New(t)
+	scheduler, clock, commandGateway, eventStore := newSchedulerTest(persist.NewMemScheduleStore())
+	assert.Nil(commandGateway.Dispatch(createBar))
+	assert.Nil(commandGateway.Dispatch(configureBar))
+
+	clock.Advance(paymentPeriod)
+	delivered, err := scheduler.FireDue(context.Background())
+
+	assert.Nil(err)
+	assert.Equal(0, delivered)
+	events, _ := eventStore.Load(context.Background(), barId)
+	assert.Equal(2, len(events))
+}
+
+func TestScheduler_commandSurvivesRestart(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store, err := persist.NewFileScheduleStore(dir)
+	assert.Nil(err)
+	scheduler, _, _, _ := newSchedulerTest(store)
+	at := schedulerEpoch.Add(time.Hour)
+	_, err = scheduler.ScheduleCommand(context.Background(), at, createBar)
+	assert.Nil(err)
+
+	store, _ = persist.NewFileScheduleStore(dir)
+	scheduler, clock, _, eventStore := newSchedulerTest(store)
+	clock.Set(at)
+	delivered, err := scheduler.FireDue(context.Background())
+
+	assert.Nil(err)
+	assert.Equal(1, delivered)
+	events, _ := eventStore.Load(context.Background(), barId)
+	assert.Equal(1, len(events))
+}
+
+func TestScheduler_rejectedCommandIsDropped(t *testing.T) {
+	assert := assert.New(t)
+	scheduler, clock, _, _ := newSchedulerTest(persist.NewMemScheduleStore())
+	// the foo has not been created, so its command handler rejects naming it
+	_, err := scheduler.ScheduleCommand(context.Background(), clock.Now(), nameFooCommand{fooId, "a name"})
+	assert.Nil(err)
+
+	delivered, err := scheduler.FireDue(context.Background())
+	assert.NotNil(err)
+	assert.Equal(0, delivered)
+
+	delivered, err = scheduler.FireDue(context.Background())
+	assert.Nil(err)
+	assert.Equal(0, delivered)
+}
+
+func TestScheduler_commandWithoutHandlerIsKept(t *testing.T) {
+	assert := assert.New(t)
+	store := persist.NewMemScheduleStore()
+	scheduler, clock, _, _ := newSchedulerTest(store)
+	_, err := scheduler.ScheduleCommand(context.Background(), clock.Now(), notConfiguredCommand{barId})
+	assert.Nil(err)
+
+	for i := 0; i < 2; i++ {
+		_, err = scheduler.FireDue(context.Background())
+		assert.True(errors.Is(err, cqrs.ErrMisconfiguration))
+	}
+	scheduled, _ := store.DueSchedules(context.Background(), clock.Now())
+	assert.Equal(1, len(scheduled))
+}
+
+func TestScheduler_closedEventStoreIsKept(t *testing.T) {
+	assert := assert.New(t)
+	eventStore, err := persist.NewFileEventStore(t.TempDir(), NewEventBus())
+	assert.Nil(err)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&barAggregate{})
+	store := persist.NewMemScheduleStore()
+	scheduler := NewScheduler(store, NewFakeClock(schedulerEpoch), commandGateway, NewEventBus())
+	_, err = scheduler.ScheduleCommand(context.Background(), schedulerEpoch, createBar)
+	assert.Nil(err)
+	assert.Nil(eventStore.Close())
+
+	_, err = scheduler.FireDue(context.Background())
+
+	assert.True(errors.Is(err, persist.ErrStoreClosed))
+	scheduled, _ := store.DueSchedules(context.Background(), schedulerEpoch)
+	assert.Equal(1, len(scheduled))
+}
+
+func TestScheduler_fromCommandHandler(t *testing.T) {
+	eventStore := persist.NewMemEventStore(NewEventBus())
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&reminderAggregate{})
+	store := persist.NewMemScheduleStore()
+	commandGateway.SetScheduler(NewScheduler(store, NewFakeClock(schedulerEpoch), commandGateway, NewEventBus()))
+
+	assert.Nil(t, commandGateway.Dispatch(createBar))
+
+	scheduled, _ := store.DueSchedules(context.Background(), schedulerEpoch.Add(paymentPeriod))
+	assert.Equal(t, 1, len(scheduled))
+	assert.Equal(t, configureBarCommand{barId, "a reminder"}, scheduled[0].Command)
+}
+
+func TestScheduler_transientFailureIsKept(t *testing.T) {
+	assert := assert.New(t)
+	store := persist.NewMemScheduleStore()
+	dispatcher := &failingDispatcher{err: cqrs.ErrConcurrencyConflict}
+	scheduler := NewScheduler(store, NewFakeClock(schedulerEpoch), dispatcher, NewEventBus())
+	_, err := scheduler.ScheduleCommand(context.Background(), schedulerEpoch, createBar)
+	assert.Nil(err)
+
+	delivered, err := scheduler.FireDue(context.Background())
+	assert.True(errors.Is(err, cqrs.ErrConcurrencyConflict))
+	assert.Equal(0, delivered)
+
+	dispatcher.err = nil
+	delivered, err = scheduler.FireDue(context.Background())
+	assert.Nil(err)
+	assert.Equal(1, delivered)
+	scheduled, _ := store.DueSchedules(context.Background(), schedulerEpoch)
+	assert.Equal(0, len(scheduled))
+}
+
+func TestScheduler_unreadableScheduleIsSkipped(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store, err := persist.NewFileScheduleStore(dir)
+	assert.Nil(err)
+	scheduler, _, _, _ := newSchedulerTest(store)
+	_, err = scheduler.ScheduleCommand(context.Background(), schedulerEpoch, createBar)
+	assert.Nil(err)
+	_, err = scheduler.ScheduleEvent(context.Background(), schedulerEpoch, barDeadlineEvent{barId})
+	assert.Nil(err)
+
+	// a new process that has not registered the deadline event's type
+	registry := persist.NewTypeRegistry()
+	assert.Nil(registry.Register(createBarCommand{}))
+	store, _ = persist.NewFileScheduleStore(dir, persist.WithTypeRegistry(registry))
+	scheduler, _, _, eventStore := newSchedulerTest(store)
+	delivered, err := scheduler.FireDue(context.Background())
+
+	assert.True(errors.Is(err, cqrs.ErrSerialization))
+	assert.Equal(1, delivered)
+	events, _ := eventStore.Load(context.Background(), barId)
+	assert.Equal(1, len(events))
+}
+
+func TestScheduler_fromCommandHandlerRetried(t *testing.T) {
+	eventStore := &racingEventStore{EventStore: persist.NewMemEventStore(NewEventBus()), interleave: []cqrs.Event{barCreatedEvent{barId}, barCreatedEvent{barId}}}
+	commandGateway := NewCommandGateway(eventStore).SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+	commandGateway.RegisterAggregate(&reminderAggregate{})
+	store := persist.NewMemScheduleStore()
+	commandGateway.SetScheduler(NewScheduler(store, NewFakeClock(schedulerEpoch), commandGateway, NewEventBus()))
+
+	assert.Nil(t, commandGateway.Dispatch(createBar))
+
+	scheduled, _ := store.DueSchedules(context.Background(), schedulerEpoch.Add(paymentPeriod))
+	assert.Equal(t, 1, len(scheduled))
+}
+
+func TestScheduler_fromFailedCommand(t *testing.T) {
+	eventStore := &racingEventStore{EventStore: persist.NewMemEventStore(NewEventBus()), interleave: []cqrs.Event{barCreatedEvent{barId}}}
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&reminderAggregate{})
+	store := persist.NewMemScheduleStore()
+	commandGateway.SetScheduler(NewScheduler(store, NewFakeClock(schedulerEpoch), commandGateway, NewEventBus()))
+
+	assert.True(t, errors.Is(commandGateway.Dispatch(createBar), cqrs.ErrConcurrencyConflict))
+
+	scheduled, _ := store.DueSchedules(context.Background(), schedulerEpoch.Add(paymentPeriod))
+	assert.Equal(t, 0, len(scheduled))
+}
+
+func TestScheduler_deadlineReachesTrackingProcessor(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&barAggregate{})
+	clock := NewFakeClock(schedulerEpoch)
+	scheduler := NewScheduler(persist.NewMemScheduleStore(), clock, commandGateway, eventBus)
+	sagaManager := NewSagaManager(commandGateway, persist.NewMemSagaStore()).SetScheduler(scheduler)
+	assert.Nil(sagaManager.RegisterSaga(&barPaymentSaga{}))
+	processor, err := NewTrackingProcessor(context.Background(), "sagas", eventStore, eventBus, persist.NewMemCheckpointStore(), sagaManager)
+	assert.Nil(err)
+	defer processor.Close()
+	assert.Nil(commandGateway.Dispatch(createBar))
+
+	clock.Advance(paymentPeriod)
+	delivered, err := scheduler.FireDue(context.Background())
+
+	assert.Nil(err)
+	assert.Equal(1, delivered)
+	events, _ := eventStore.Load(context.Background(), barId)
+	assert.Equal(2, len(events))
+	assert.Equal(barConfiguredEvent{barId, "expired"}, events[1].Event)
+	assert.Equal(int64(2), processor.Position())
+}
+
+func TestScheduler_run(t *testing.T) {
+	scheduler, clock, _, eventStore := newSchedulerTest(persist.NewMemScheduleStore())
+	scheduler.SetPollInterval(time.Minute)
+	_, err := scheduler.ScheduleCommand(context.Background(), schedulerEpoch.Add(time.Hour), createBar)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- scheduler.Run(ctx, nil) }()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		clock.Advance(time.Minute)
+		if _, err := eventStore.Load(context.Background(), barId); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("scheduled command was not dispatched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-stopped)
+}
+
+func TestFakeClock_after(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	after := clock.After(time.Hour)
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, 0, len(after))
+	clock.Advance(time.Hour)
+
+	assert.Equal(t, schedulerEpoch.Add(time.Hour+time.Minute), <-after)
+	assert.Equal(t, 1, len(clock.After(0)))
+}
+
+// barPaymentSaga gives a new bar three days to be configured before configuring it itself.
+type barPaymentSaga struct {
+	SagaLifecycle
+	DeadlineId string
+}
+
+type barDeadlineEvent struct {
+	Id string
+}
+
+func (e barDeadlineEvent) AggregateId() string { return e.Id }
+
+func (s *barPaymentSaga) StartOnBarCreated(ctx context.Context, e barCreatedEvent) ([]cqrs.Command, error) {
+	scheduler := SchedulerFromContext(ctx)
+	deadlineId, err := scheduler.ScheduleEvent(ctx, scheduler.Clock().Now().Add(paymentPeriod), barDeadlineEvent{e.Id})
+	s.DeadlineId = deadlineId
+	return nil, err
+}
+func (s *barPaymentSaga) OnBarConfigured(ctx context.Context, e barConfiguredEvent) ([]cqrs.Command, error) {
+	s.End()
+	return nil, SchedulerFromContext(ctx).Cancel(ctx, s.DeadlineId)
+}
+func (s *barPaymentSaga) OnBarDeadline(e barDeadlineEvent) ([]cqrs.Command, error) {
+	s.End()
+	return []cqrs.Command{configureBarCommand{e.Id, "expired"}}, nil
+}
+
+// reminderAggregate schedules a configuration for every bar it creates.
+type reminderAggregate struct{}
+
+func (a *reminderAggregate) HandleCreateBar(ctx context.Context, c createBarCommand) ([]cqrs.Event, error) {
+	scheduler := SchedulerFromContext(ctx)
+	_, err := scheduler.ScheduleCommand(ctx, scheduler.Clock().Now().Add(paymentPeriod), configureBarCommand{c.Id, "a reminder"})
+	return []cqrs.Event{barCreatedEvent{c.Id}}, err
+}
+
+type failingDispatcher struct {
+	err error
+}
+
+func (d *failingDispatcher) DispatchContext(ctx context.Context, command cqrs.Command) error {
+	return d.err
+}
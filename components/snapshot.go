@@ -0,0 +1,83 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"reflect"
+	"time"
+)
+
+var snapshotterInterface = reflect.TypeOf((*cqrs.Snapshotter)(nil)).Elem()
+
+// SnapshotPolicy decides after each successful dispatch whether a new snapshot of the aggregate should be
+// taken. eventsSinceSnapshot counts the events in the stream that the latest usable snapshot does not cover.
+type SnapshotPolicy interface {
+	ShouldSnapshot(aggregateType reflect.Type, version int, eventsSinceSnapshot int) bool
+}
+
+// EveryNEvents takes a snapshot once the given number of events have been written since the last one.
+type EveryNEvents int
+
+func (n EveryNEvents) ShouldSnapshot(_ reflect.Type, _ int, eventsSinceSnapshot int) bool {
+	return n > 0 && eventsSinceSnapshot >= int(n)
+}
+
+// SnapshotPolicyByType applies a different policy to each aggregate type, keyed by the type passed to
+// RegisterAggregate. Aggregates without an entry are never snapshotted.
+type SnapshotPolicyByType map[reflect.Type]SnapshotPolicy
+
+func (p SnapshotPolicyByType) ShouldSnapshot(aggregateType reflect.Type, version int, eventsSinceSnapshot int) bool {
+	policy, ok := p[aggregateType]
+	return ok && policy.ShouldSnapshot(aggregateType, version, eventsSinceSnapshot)
+}
+
+func canSnapshot(aggregateType reflect.Type) bool {
+	return aggregateType.Implements(snapshotterInterface)
+}
+
+func aggregateTypeName(aggregateType reflect.Type) string {
+	if aggregateType.Kind() == reflect.Ptr {
+		aggregateType = aggregateType.Elem()
+	}
+	return aggregateType.PkgPath() + "." + aggregateType.Name()
+}
+
+// restoreSnapshot returns a fresh aggregate and version 0 unless a snapshot of the aggregate exists and
+// was taken under the schema version it currently reports. A snapshot that cannot be used is ignored,
+// costing nothing more than a full replay, but a failure to load one is returned.
+func restoreSnapshot(ctx context.Context, store cqrs.SnapshotStore, aggregateType reflect.Type, aggregateId string) (reflect.Value, int, error) {
+	aggregate := reflect.New(aggregateType.Elem())
+	snapshot, err := store.LoadSnapshot(ctx, aggregateId)
+	if errors.Is(err, cqrs.ErrSnapshotNotFound) {
+		return aggregate, 0, nil
+	}
+	if err != nil {
+		return aggregate, 0, err
+	}
+	snapshotter := aggregate.Interface().(cqrs.Snapshotter)
+	if snapshot.AggregateType != aggregateTypeName(aggregateType) || snapshot.SchemaVersion != snapshotter.SnapshotSchemaVersion() {
+		return aggregate, 0, nil
+	}
+	if err := snapshotter.UnmarshalSnapshot(snapshot.Payload); err != nil {
+		return reflect.New(aggregateType.Elem()), 0, nil
+	}
+	return aggregate, snapshot.Version, nil
+}
+
+func takeSnapshot(ctx context.Context, store cqrs.SnapshotStore, aggregate reflect.Value, aggregateId string, version int) error {
+	snapshotter := aggregate.Interface().(cqrs.Snapshotter)
+	payload, err := snapshotter.MarshalSnapshot()
+	if err != nil {
+		return fmt.Errorf("%w: snapshot of %s: %v", cqrs.ErrSerialization, aggregateId, err)
+	}
+	return store.SaveSnapshot(ctx, cqrs.Snapshot{
+		AggregateId:   aggregateId,
+		AggregateType: aggregateTypeName(aggregate.Type()),
+		Version:       version,
+		SchemaVersion: snapshotter.SnapshotSchemaVersion(),
+		Timestamp:     time.Now().UTC(),
+		Payload:       payload,
+	})
+}
@@ -0,0 +1,149 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const snapshotCounterSchema = 1
+
+func TestCommandGateway_snapshotsBoundReplay(t *testing.T) {
+	assert := assert.New(t)
+	commandGateway, eventStore, snapshotStore := newSnapshotTestGateway(EveryNEvents(3))
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(commandGateway.Dispatch(incrementCommand{Id: counterId}))
+	}
+
+	assert.Equal([]int{0, 0, 0, 3, 2, 3}, eventStore.loadedFrom)
+	snapshot, err := snapshotStore.LoadSnapshot(context.Background(), counterId)
+	assert.Nil(err)
+	assert.Equal(3, snapshot.Version)
+	assert.Equal("3", string(snapshot.Payload))
+	events, _ := eventStore.Load(context.Background(), counterId)
+	assert.Equal(counterIncrementedEvent{counterId, 5}, events[4].Event)
+}
+
+func TestCommandGateway_staleSnapshotDiscarded(t *testing.T) {
+	assert := assert.New(t)
+	commandGateway, eventStore, snapshotStore := newSnapshotTestGateway(EveryNEvents(10))
+	assert.Nil(commandGateway.Dispatch(incrementCommand{Id: counterId}))
+	snapshotStore.SaveSnapshot(context.Background(), cqrs.Snapshot{
+		AggregateId:   counterId,
+		AggregateType: aggregateTypeName(reflect.TypeOf(&snapshotCounterAggregate{})),
+		Version:       1,
+		SchemaVersion: snapshotCounterSchema + 1,
+		Payload:       []byte("100"),
+	})
+
+	assert.Nil(commandGateway.Dispatch(incrementCommand{Id: counterId}))
+
+	assert.Equal([]int{0, 0}, eventStore.loadedFrom)
+	events, _ := eventStore.Load(context.Background(), counterId)
+	assert.Equal(counterIncrementedEvent{counterId, 2}, events[1].Event)
+}
+
+func TestCommandGateway_snapshotPastStreamEndDiscarded(t *testing.T) {
+	assert := assert.New(t)
+	commandGateway, eventStore, snapshotStore := newSnapshotTestGateway(EveryNEvents(10))
+	assert.Nil(commandGateway.Dispatch(incrementCommand{Id: counterId}))
+	snapshotStore.SaveSnapshot(context.Background(), cqrs.Snapshot{
+		AggregateId:   counterId,
+		AggregateType: aggregateTypeName(reflect.TypeOf(&snapshotCounterAggregate{})),
+		Version:       5,
+		SchemaVersion: snapshotCounterSchema,
+		Payload:       []byte("5"),
+	})
+
+	assert.Nil(commandGateway.Dispatch(incrementCommand{Id: counterId}))
+
+	assert.Equal([]int{0, 5, 4, 0}, eventStore.loadedFrom)
+	events, _ := eventStore.Load(context.Background(), counterId)
+	assert.Equal(counterIncrementedEvent{counterId, 2}, events[1].Event)
+}
+
+func TestCommandGateway_snapshotLoadFailure(t *testing.T) {
+	assert := assert.New(t)
+	eventStore := persist.NewMemEventStore(NewEventBus())
+	failure := errors.New("snapshot store unavailable")
+	commandGateway := NewCommandGateway(eventStore).SetSnapshotStore(failingSnapshotStore{failure}, EveryNEvents(1))
+	commandGateway.RegisterAggregate(&snapshotCounterAggregate{})
+
+	assert.Equal(failure, commandGateway.Dispatch(incrementCommand{Id: counterId}))
+
+	_, err := eventStore.Load(context.Background(), counterId)
+	assert.True(errors.Is(err, cqrs.ErrStreamNotFound))
+}
+
+func TestCommandGateway_snapshotPolicyByType(t *testing.T) {
+	policy := SnapshotPolicyByType{reflect.TypeOf(&counterAggregate{}): EveryNEvents(1)}
+	commandGateway, _, snapshotStore := newSnapshotTestGateway(policy)
+
+	assert.Nil(t, commandGateway.Dispatch(incrementCommand{Id: counterId}))
+
+	_, err := snapshotStore.LoadSnapshot(context.Background(), counterId)
+	assert.True(t, errors.Is(err, cqrs.ErrSnapshotNotFound))
+}
+
+func newSnapshotTestGateway(policy SnapshotPolicy) (*CommandGateway, *loadRecordingEventStore, cqrs.SnapshotStore) {
+	eventStore := &loadRecordingEventStore{EventStore: persist.NewMemEventStore(NewEventBus())}
+	snapshotStore := persist.NewMemSnapshotStore()
+	commandGateway := NewCommandGateway(eventStore).SetSnapshotStore(snapshotStore, policy)
+	commandGateway.RegisterAggregate(&snapshotCounterAggregate{})
+	return commandGateway, eventStore, snapshotStore
+}
+
+// loadRecordingEventStore records the version after which each load started.
+type loadRecordingEventStore struct {
+	cqrs.EventStore
+	loadedFrom []int
+}
+
+func (s *loadRecordingEventStore) Load(ctx context.Context, aggregateId string) ([]*cqrs.EventEnvelope, error) {
+	s.loadedFrom = append(s.loadedFrom, 0)
+	return s.EventStore.Load(ctx, aggregateId)
+}
+
+func (s *loadRecordingEventStore) LoadFrom(ctx context.Context, aggregateId string, afterVersion int) ([]*cqrs.EventEnvelope, error) {
+	s.loadedFrom = append(s.loadedFrom, afterVersion)
+	return s.EventStore.LoadFrom(ctx, aggregateId, afterVersion)
+}
+
+type failingSnapshotStore struct {
+	err error
+}
+
+func (s failingSnapshotStore) SaveSnapshot(ctx context.Context, snapshot cqrs.Snapshot) error {
+	return s.err
+}
+func (s failingSnapshotStore) LoadSnapshot(ctx context.Context, aggregateId string) (*cqrs.Snapshot, error) {
+	return nil, s.err
+}
+
+type snapshotCounterAggregate struct {
+	count int
+}
+
+func (a *snapshotCounterAggregate) HandleIncrement(c incrementCommand) ([]cqrs.Event, error) {
+	return []cqrs.Event{counterIncrementedEvent{c.Id, a.count + 1}}, nil
+}
+func (a *snapshotCounterAggregate) OnIncremented(e counterIncrementedEvent) {
+	a.count++
+}
+
+func (a *snapshotCounterAggregate) SnapshotSchemaVersion() int { return snapshotCounterSchema }
+func (a *snapshotCounterAggregate) MarshalSnapshot() ([]byte, error) {
+	return []byte(strconv.Itoa(a.count)), nil
+}
+func (a *snapshotCounterAggregate) UnmarshalSnapshot(data []byte) error {
+	count, err := strconv.Atoi(string(data))
+	a.count = count
+	return err
+}
@@ -0,0 +1,23 @@
+package components
+
+import "sync"
+
+// Subscription is returned by RegisterQueryEventHandlers and removes the listener's subscriptions when
+// closed. Closing it more than once has no further effect.
+type Subscription struct {
+	registry  *listenerRegistry
+	listeners []*queryEventListener
+	once      sync.Once
+}
+
+func (subscription *Subscription) Close() {
+	subscription.once.Do(func() {
+		subscribed := make(map[*queryEventListener]bool, len(subscription.listeners))
+		for _, listener := range subscription.listeners {
+			subscribed[listener] = true
+		}
+		subscription.registry.remove(func(listener *queryEventListener) bool {
+			return subscribed[listener]
+		})
+	})
+}
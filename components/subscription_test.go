@@ -0,0 +1,65 @@
+package components
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscription_Close(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus()
+	calls := &callLog{}
+	subscription := eventBus.RegisterQueryEventHandlers(&allEventsListener{calls})
+	eventBus.RegisterQueryEventHandlers(&fooNamedListener{calls})
+
+	subscription.Close()
+	subscription.Close()
+	assert.Nil(eventBus.PublishEvents(context.Background(), wrapEvents(fooNamedEvent{fooId, "a name"})))
+
+	assert.Equal([]string{"named components.fooNamedEvent"}, calls.entries())
+}
+
+func TestEventBus_Unsubscribe(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus()
+	calls := &callLog{}
+	listener := &fooNamedListener{calls}
+	eventBus.RegisterQueryEventHandlers(listener)
+	eventBus.RegisterQueryEventHandlers(listener)
+	eventBus.RegisterQueryEventHandlers(&allEventsListener{calls})
+
+	eventBus.Unsubscribe(listener)
+	assert.Nil(eventBus.PublishEvents(context.Background(), wrapEvents(fooNamedEvent{fooId, "a name"})))
+
+	assert.Equal([]string{"all components.fooNamedEvent"}, calls.entries())
+	assert.Equal(1, len(eventBus.queryEventListeners))
+}
+
+func TestEventBus_subscribeWhilePublishing(t *testing.T) {
+	eventBus := NewEventBus()
+	eventBus.RegisterQueryEventHandlers(&fooNamedListener{&callLog{}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				eventBus.PublishEvents(context.Background(), wrapEvents(fooNamedEvent{fooId, "a name"}))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				eventBus.RegisterQueryEventHandlers(&allEventsListener{&callLog{}}).Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, len(eventBus.listenersFor(reflect.TypeOf(fooNamedEvent{}))))
+}
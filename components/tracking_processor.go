@@ -0,0 +1,55 @@
+package components
+
+import (
+	"context"
+	"github.com/davegarred/cqrs"
+)
+
+// TrackingProcessor delivers the global event stream to a listener and saves the position of every event
+// the listener has handled as the processor's checkpoint. After a restart it resumes right after the
+// checkpoint; an event handled just before a crash, whose checkpoint was not yet saved, is delivered
+// again, so listeners should tolerate seeing their last event twice.
+type TrackingProcessor struct {
+	name         string
+	checkpoints  cqrs.CheckpointStore
+	subscription *CatchUpSubscription
+}
+
+// NewTrackingProcessor starts delivering events after the processor's checkpoint to the listener and
+// returns once the listener has caught up with the store.
+func NewTrackingProcessor(ctx context.Context, name string, eventStore cqrs.EventStore, eventBus Subscriber, checkpoints cqrs.CheckpointStore, listener interface{}) (*TrackingProcessor, error) {
+	position, err := checkpoints.LoadCheckpoint(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	processor := &TrackingProcessor{
+		name:         name,
+		checkpoints:  checkpoints,
+		subscription: newCatchUpSubscription(eventStore, position, listener),
+	}
+	processor.subscription.delivered = processor.saveCheckpoint
+	if err := processor.subscription.start(ctx, eventBus); err != nil {
+		return nil, err
+	}
+	return processor, nil
+}
+
+// Position returns the position of the last event delivered to the listener.
+func (processor *TrackingProcessor) Position() int64 {
+	return processor.subscription.Position()
+}
+
+// DeadLetters returns the store holding the events the listener failed to handle.
+func (processor *TrackingProcessor) DeadLetters() DeadLetterStore {
+	return processor.subscription.DeadLetters()
+}
+
+func (processor *TrackingProcessor) Close() {
+	processor.subscription.Close()
+}
+
+// saveCheckpoint outlives the caller's context so that an event handled is never left unrecorded
+// because the caller gave up.
+func (processor *TrackingProcessor) saveCheckpoint(ctx context.Context, position int64) error {
+	return processor.checkpoints.SaveCheckpoint(context.WithoutCancel(ctx), processor.name, position)
+}
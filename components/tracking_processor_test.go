@@ -0,0 +1,66 @@
+package components
+
+import (
+	"context"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/persist"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackingProcessor_resumesFromCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	checkpoints, err := persist.NewFileCheckpointStore(t.TempDir())
+	assert.Nil(err)
+	assert.Nil(eventStore.Persist(context.Background(), fooId, 0, wrapEvents(fooNamedEvent{fooId, "a name"}, fooNamedEvent{fooId, "a name"})))
+
+	listener := &positionListener{}
+	processor, err := NewTrackingProcessor(context.Background(), "positions", eventStore, eventBus, checkpoints, listener)
+	assert.Nil(err)
+	assert.Nil(eventStore.Persist(context.Background(), fooId, 2, wrapEvents(fooNamedEvent{fooId, "a name"})))
+	processor.Close()
+	assert.Nil(eventStore.Persist(context.Background(), fooId, 3, wrapEvents(fooNamedEvent{fooId, "a name"}, fooNamedEvent{fooId, "a name"})))
+
+	assert.Equal([]int64{1, 2, 3}, listener.delivered())
+	position, _ := checkpoints.LoadCheckpoint(context.Background(), "positions")
+	assert.Equal(int64(3), position)
+
+	restarted := &positionListener{}
+	processor, err = NewTrackingProcessor(context.Background(), "positions", eventStore, eventBus, checkpoints, restarted)
+	assert.Nil(err)
+	defer processor.Close()
+
+	assert.Equal([]int64{4, 5}, restarted.delivered())
+	assert.Equal(int64(5), processor.Position())
+	position, _ = checkpoints.LoadCheckpoint(context.Background(), "positions")
+	assert.Equal(int64(5), position)
+}
+
+func TestTrackingProcessor_listenerDispatchesCommand(t *testing.T) {
+	eventBus := NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	sagaManager := NewSagaManager(commandGateway, persist.NewMemSagaStore())
+	assert.Nil(t, sagaManager.RegisterSaga(&fooNamingSaga{}))
+	processor, err := NewTrackingProcessor(context.Background(), "sagas", eventStore, eventBus, persist.NewMemCheckpointStore(), sagaManager)
+	assert.Nil(t, err)
+	defer processor.Close()
+
+	dispatched := make(chan error)
+	go func() { dispatched <- commandGateway.Dispatch(createFoo) }()
+	select {
+	case err := <-dispatched:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("dispatch did not return")
+	}
+
+	events, _ := eventStore.Load(context.Background(), fooId)
+	assert.Equal(t, []cqrs.Event{fooCreatedEvent{fooId}, fooNamedEvent{fooId, "named by a saga"}}, cqrs.Events(events))
+	assert.Equal(t, int64(2), processor.Position())
+}
@@ -0,0 +1,16 @@
+package cqrs
+
+import "context"
+
+type metadataKey struct{}
+
+// ContextWithMetadata attaches metadata to a context so that it is stamped on the events produced
+// by a command dispatched with that context.
+func ContextWithMetadata(ctx context.Context, metadata Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+func MetadataFromContext(ctx context.Context) Metadata {
+	metadata, _ := ctx.Value(metadataKey{}).(Metadata)
+	return metadata
+}
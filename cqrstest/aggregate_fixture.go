@@ -0,0 +1,156 @@
+// Package cqrstest provides fixtures for testing aggregates, projections and sagas in the
+// given/when/then style.
+package cqrstest
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/components"
+	"github.com/davegarred/cqrs/internal/testhooks"
+	"github.com/davegarred/cqrs/persist"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/stretchr/testify/assert"
+)
+
+// stateDumper prints aggregates deterministically, unexported fields included, so that two dumps of
+// the same state are equal.
+var stateDumper = spew.ConfigState{Indent: "  ", DisablePointerAddresses: true, DisableCapacities: true, SortKeys: true}
+
+// AggregateFixture dispatches a command to an aggregate rebuilt from the given events and checks the
+// outcome:
+//
+//	cqrstest.NewAggregateFixture(t, &OrderAggregate{}).
+//		Given(OrderPlaced{Id: "an_order"}).
+//		When(PayOrder{Id: "an_order"}).
+//		ExpectEvents(OrderPaid{Id: "an_order"})
+//
+// The command fails the test if its handler changes the aggregate's state, which must only change in
+// the aggregate's event listeners.
+type AggregateFixture struct {
+	t          testing.TB
+	eventStore cqrs.EventStore
+	gateway    *components.CommandGateway
+	observer   *mutationObserver
+}
+
+// AggregateResult is the outcome of the command passed to AggregateFixture.When.
+type AggregateResult struct {
+	t      testing.TB
+	events []cqrs.Event
+	err    error
+}
+
+func NewAggregateFixture(t testing.TB, aggregate interface{}) *AggregateFixture {
+	eventStore := persist.NewMemEventStore(components.NewEventBus())
+	gateway := components.NewCommandGateway(eventStore)
+	gateway.RegisterAggregate(aggregate)
+	return &AggregateFixture{t: t, eventStore: eventStore, gateway: gateway, observer: &mutationObserver{}}
+}
+
+// Given records past events, which may belong to several aggregates. It may be called more than once.
+func (fixture *AggregateFixture) Given(events ...cqrs.Event) *AggregateFixture {
+	fixture.t.Helper()
+	for _, event := range events {
+		envelopes := cqrs.NewEventEnvelopes([]cqrs.Event{event}, cqrs.Metadata{})
+		if err := fixture.eventStore.Persist(context.Background(), event.AggregateId(), cqrs.AnyVersion, envelopes); err != nil {
+			fixture.t.Fatalf("given event %T could not be stored: %v", event, err)
+		}
+	}
+	return fixture
+}
+
+func (fixture *AggregateFixture) When(command cqrs.Command) *AggregateResult {
+	return fixture.WhenContext(context.Background(), command)
+}
+
+// WhenContext dispatches the command with ctx, which reaches command handlers that take one.
+func (fixture *AggregateFixture) WhenContext(ctx context.Context, command cqrs.Command) *AggregateResult {
+	fixture.t.Helper()
+	fixture.observer.reset()
+	err := fixture.gateway.DispatchContext(testhooks.ContextWithHandlerObserver(ctx, fixture.observer), command)
+	if fixture.observer.mutation != "" {
+		fixture.t.Errorf("command handler for %T changed the state of the aggregate; state must only change in event listeners:\n%s", command, fixture.observer.mutation)
+	}
+	return &AggregateResult{t: fixture.t, events: fixture.observer.events, err: err}
+}
+
+// ExpectEvents checks that the command succeeded and produced exactly the events, in order.
+func (result *AggregateResult) ExpectEvents(events ...cqrs.Event) *AggregateResult {
+	result.t.Helper()
+	if result.err != nil {
+		result.t.Errorf("expected events, but the command failed: %v", result.err)
+		return result
+	}
+	assert.Equal(result.t, normalize(events), normalize(result.events))
+	return result
+}
+
+func (result *AggregateResult) ExpectNoEvents() *AggregateResult {
+	result.t.Helper()
+	return result.ExpectEvents()
+}
+
+// ExpectError checks that the command failed with an error matching target as reported by errors.Is.
+func (result *AggregateResult) ExpectError(target error) *AggregateResult {
+	result.t.Helper()
+	if result.err == nil {
+		result.t.Errorf("expected error %v, but the command succeeded with events:\n%s", target, stateDumper.Sdump(result.events))
+	} else if !errors.Is(result.err, target) {
+		result.t.Errorf("expected error %v, but the command failed with: %v", target, result.err)
+	}
+	return result
+}
+
+// Events returns the events the command produced, for checks beyond ExpectEvents.
+func (result *AggregateResult) Events() []cqrs.Event {
+	return result.events
+}
+
+func (result *AggregateResult) Err() error {
+	return result.err
+}
+
+// mutationObserver records the events produced by the command handler and the difference, if any,
+// between the aggregate's state before and after the handler ran.
+type mutationObserver struct {
+	before   string
+	events   []cqrs.Event
+	mutation string
+}
+
+func (observer *mutationObserver) reset() {
+	observer.before, observer.events, observer.mutation = "", nil, ""
+}
+
+func (observer *mutationObserver) BeforeCommand(aggregate interface{}, command cqrs.Command) {
+	observer.before = stateDumper.Sdump(aggregate)
+}
+
+func (observer *mutationObserver) AfterCommand(aggregate interface{}, command cqrs.Command, events []cqrs.Event, err error) {
+	observer.events = events
+	if after := stateDumper.Sdump(aggregate); after != observer.before {
+		observer.mutation = diff(observer.before, after)
+	}
+}
+
+func diff(before, after string) string {
+	unified, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(before),
+		B:        difflib.SplitLines(after),
+		FromFile: "before",
+		ToFile:   "after",
+		Context:  2,
+	})
+	return unified
+}
+
+func normalize(events []cqrs.Event) []cqrs.Event {
+	if events == nil {
+		return []cqrs.Event{}
+	}
+	return events
+}
@@ -0,0 +1,151 @@
+package cqrstest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const accountId = "an_account_id"
+
+var errInsufficientFunds = errors.New("insufficient funds")
+
+func TestAggregateFixture_expectEvents(t *testing.T) {
+	NewAggregateFixture(t, &accountAggregate{}).
+		Given(accountOpened{accountId}, deposited{accountId, 10}).
+		When(withdraw{accountId, 4}).
+		ExpectEvents(withdrawn{accountId, 4})
+}
+
+func TestAggregateFixture_expectError(t *testing.T) {
+	NewAggregateFixture(t, &accountAggregate{}).
+		Given(accountOpened{accountId}).
+		When(withdraw{accountId, 4}).
+		ExpectError(errInsufficientFunds)
+}
+
+func TestAggregateFixture_expectNoEvents(t *testing.T) {
+	NewAggregateFixture(t, &accountAggregate{}).
+		Given(accountOpened{accountId}).
+		When(withdraw{accountId, 0}).
+		ExpectNoEvents()
+}
+
+func TestAggregateFixture_reportsMismatches(t *testing.T) {
+	recorder := &recordingT{TB: t}
+	fixture := NewAggregateFixture(recorder, &accountAggregate{}).Given(accountOpened{accountId}, deposited{accountId, 10})
+
+	fixture.When(withdraw{accountId, 4}).ExpectEvents(withdrawn{accountId, 5})
+	fixture.When(withdraw{accountId, 4}).ExpectError(errInsufficientFunds)
+	fixture.When(withdraw{accountId, 40}).ExpectEvents(withdrawn{accountId, 40})
+	fixture.When(withdraw{accountId, 40}).ExpectError(cqrs.ErrStreamNotFound)
+
+	assert.Equal(t, 4, len(recorder.failures))
+	assert.Contains(t, recorder.failures[0], "-  Amount: (int) 5")
+	assert.Contains(t, recorder.failures[1], "command succeeded")
+	assert.Contains(t, recorder.failures[2], "insufficient funds")
+	assert.Contains(t, recorder.failures[3], "insufficient funds")
+}
+
+func TestAggregateFixture_detectsMutatingHandler(t *testing.T) {
+	recorder := &recordingT{TB: t}
+
+	NewAggregateFixture(recorder, &accountAggregate{}).
+		Given(accountOpened{accountId}, deposited{accountId, 10}).
+		When(closeAccount{accountId}).
+		ExpectEvents(accountClosed{accountId})
+
+	assert.Equal(t, 1, len(recorder.failures))
+	assert.Contains(t, recorder.failures[0], "changed the state of the aggregate")
+	assert.Contains(t, recorder.failures[0], "+  closed: (bool) true")
+}
+
+// recordingT collects the failures a fixture reports instead of failing the test.
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingT) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+}
+
+type accountAggregate struct {
+	id      string
+	balance int
+	closed  bool
+}
+
+func (a *accountAggregate) HandleWithdraw(c withdraw) ([]cqrs.Event, error) {
+	if c.Amount > a.balance {
+		return nil, fmt.Errorf("%w: %d is more than the balance of %d", errInsufficientFunds, c.Amount, a.balance)
+	}
+	if c.Amount == 0 {
+		return nil, nil
+	}
+	return []cqrs.Event{withdrawn{c.Id, c.Amount}}, nil
+}
+
+// HandleClose wrongly changes the state itself.
+func (a *accountAggregate) HandleClose(c closeAccount) ([]cqrs.Event, error) {
+	a.closed = true
+	return []cqrs.Event{accountClosed{c.Id}}, nil
+}
+
+func (a *accountAggregate) OnAccountOpened(e accountOpened) {
+	a.id = e.Id
+}
+func (a *accountAggregate) OnDeposited(e deposited) {
+	a.balance += e.Amount
+}
+func (a *accountAggregate) OnWithdrawn(e withdrawn) {
+	a.balance -= e.Amount
+}
+
+type withdraw struct {
+	Id     string
+	Amount int
+}
+
+func (c withdraw) TargetAggregateId() string { return c.Id }
+
+type closeAccount struct {
+	Id string
+}
+
+func (c closeAccount) TargetAggregateId() string { return c.Id }
+
+type accountOpened struct {
+	Id string
+}
+
+func (e accountOpened) AggregateId() string { return e.Id }
+
+type deposited struct {
+	Id     string
+	Amount int
+}
+
+func (e deposited) AggregateId() string { return e.Id }
+
+type withdrawn struct {
+	Id     string
+	Amount int
+}
+
+func (e withdrawn) AggregateId() string { return e.Id }
+
+type accountClosed struct {
+	Id string
+}
+
+func (e accountClosed) AggregateId() string { return e.Id }
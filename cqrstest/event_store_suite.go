@@ -0,0 +1,434 @@
+package cqrstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/components"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// EventStoreFactory returns an empty store publishing to the event bus. It is called once per test of
+// the suite.
+type EventStoreFactory func(t *testing.T, eventBus cqrs.EventBus) cqrs.EventStore
+
+// RunEventStoreSuite checks that a cqrs.EventStore implementation honours the contract the rest of this
+// module relies on:
+//
+//	func TestPostgresEventStore(t *testing.T) {
+//		cqrstest.RunEventStoreSuite(t, func(t *testing.T, eventBus cqrs.EventBus) cqrs.EventStore {
+//			return newPostgresEventStore(t, eventBus)
+//		})
+//	}
+func RunEventStoreSuite(t *testing.T, newStore EventStoreFactory) {
+	t.Run("ordering", func(t *testing.T) { testOrdering(t, newStore) })
+	t.Run("isolation between aggregates", func(t *testing.T) { testIsolation(t, newStore) })
+	t.Run("empty streams", func(t *testing.T) { testEmptyStreams(t, newStore) })
+	t.Run("large streams", func(t *testing.T) { testLargeStreams(t, newStore) })
+	t.Run("concurrency conflicts", func(t *testing.T) { testConcurrencyConflicts(t, newStore) })
+	t.Run("round trip", func(t *testing.T) { testRoundTrip(t, newStore) })
+	t.Run("serialization failure", func(t *testing.T) { testSerializationFailure(t, newStore) })
+	t.Run("envelope metadata", func(t *testing.T) { testEnvelopeMetadata(t, newStore) })
+	t.Run("global positions", func(t *testing.T) { testGlobalPositions(t, newStore) })
+	t.Run("publishing", func(t *testing.T) { testPublishing(t, newStore) })
+	t.Run("cancelled context", func(t *testing.T) { testCancelledContext(t, newStore) })
+	t.Run("concurrent writers", func(t *testing.T) { testConcurrentWriters(t, newStore) })
+	t.Run("concurrent writers to one stream", func(t *testing.T) { testConcurrentWritersToOneStream(t, newStore) })
+}
+
+func testOrdering(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+	first := []cqrs.Event{suiteEvent{"an_id", 1}, suiteEvent{"an_id", 2}}
+	second := []cqrs.Event{suiteEvent{"an_id", 3}, suiteOtherEvent{"an_id", "four"}, suiteEvent{"an_id", 5}}
+
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, wrap(first...)))
+	assert.Nil(es.Persist(context.Background(), "an_id", 2, wrap(second...)))
+
+	events, err := es.Load(context.Background(), "an_id")
+	assert.Nil(err)
+	assert.Equal(append(first, second...), cqrs.Events(events))
+	for i, event := range events {
+		assert.Equal(i+1, event.Sequence)
+	}
+	events, err = es.LoadFrom(context.Background(), "an_id", 3)
+	assert.Nil(err)
+	assert.Equal(second[1:], cqrs.Events(events))
+	assert.Equal(4, events[0].Sequence)
+	events, err = es.LoadFrom(context.Background(), "an_id", 5)
+	assert.Nil(err)
+	assert.Equal(0, len(events))
+}
+
+func testIsolation(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, wrap(suiteEvent{"an_id", 1}, suiteEvent{"an_id", 2})))
+	assert.Nil(es.Persist(context.Background(), "another_id", 0, wrap(suiteEvent{"another_id", 1})))
+	assert.Nil(es.Persist(context.Background(), "an_id_too", 0, wrap(suiteEvent{"an_id_too", 1})))
+
+	events, _ := es.Load(context.Background(), "an_id")
+	assert.Equal([]cqrs.Event{suiteEvent{"an_id", 1}, suiteEvent{"an_id", 2}}, cqrs.Events(events))
+	events, _ = es.Load(context.Background(), "another_id")
+	assert.Equal([]cqrs.Event{suiteEvent{"another_id", 1}}, cqrs.Events(events))
+	assert.Equal(1, events[0].Sequence)
+	err := es.Persist(context.Background(), "another_id", 2, wrap(suiteEvent{"another_id", 2}))
+	assert.True(errors.Is(err, cqrs.ErrConcurrencyConflict))
+}
+
+func testEmptyStreams(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+
+	_, err := es.Load(context.Background(), "an_id")
+	assert.True(errors.Is(err, cqrs.ErrStreamNotFound))
+	_, err = es.LoadFrom(context.Background(), "an_id", 0)
+	assert.True(errors.Is(err, cqrs.ErrStreamNotFound))
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, nil))
+	err = es.Persist(context.Background(), "an_id", 1, nil)
+	assert.True(errors.Is(err, cqrs.ErrConcurrencyConflict))
+	events, err := es.ReadAll(context.Background(), 0, 0)
+	assert.Nil(err)
+	assert.Equal(0, len(events))
+	position, err := es.LastPosition(context.Background())
+	assert.Nil(err)
+	assert.Equal(int64(0), position)
+}
+
+func testLargeStreams(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+	const batches, batchSize = 20, 100
+
+	for batch := 0; batch < batches; batch++ {
+		events := make([]cqrs.Event, batchSize)
+		for i := range events {
+			events[i] = suiteEvent{"an_id", batch*batchSize + i + 1}
+		}
+		assert.Nil(es.Persist(context.Background(), "an_id", batch*batchSize, wrap(events...)))
+	}
+
+	events, err := es.Load(context.Background(), "an_id")
+	assert.Nil(err)
+	assert.Equal(batches*batchSize, len(events))
+	for i, event := range events {
+		if event.Sequence != i+1 || event.Event != (suiteEvent{"an_id", i + 1}) {
+			t.Fatalf("event %d is out of order: %+v", i+1, event)
+		}
+	}
+	events, _ = es.LoadFrom(context.Background(), "an_id", batches*batchSize-1)
+	assert.Equal([]cqrs.Event{suiteEvent{"an_id", batches * batchSize}}, cqrs.Events(events))
+	events, _ = es.ReadAll(context.Background(), batchSize, batchSize)
+	assert.Equal(batchSize, len(events))
+	assert.Equal(int64(batchSize+1), events[0].Position)
+}
+
+func testConcurrencyConflicts(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, wrap(suiteEvent{"an_id", 1})))
+
+	for _, expectedVersion := range []int{0, 2} {
+		err := es.Persist(context.Background(), "an_id", expectedVersion, wrap(suiteEvent{"an_id", 2}))
+
+		assert.True(errors.Is(err, cqrs.ErrConcurrencyConflict))
+		var conflict *cqrs.ConcurrencyError
+		if assert.True(errors.As(err, &conflict)) {
+			assert.Equal("an_id", conflict.AggregateId)
+			assert.Equal(expectedVersion, conflict.ExpectedVersion)
+			assert.Equal(1, conflict.ActualVersion)
+		}
+	}
+	err := es.Persist(context.Background(), "a_new_id", 1, wrap(suiteEvent{"a_new_id", 1}))
+	assert.True(errors.Is(err, cqrs.ErrConcurrencyConflict))
+	_, err = es.Load(context.Background(), "a_new_id")
+	assert.True(errors.Is(err, cqrs.ErrStreamNotFound))
+
+	assert.Nil(es.Persist(context.Background(), "an_id", cqrs.AnyVersion, wrap(suiteEvent{"an_id", 2})))
+	events, _ := es.Load(context.Background(), "an_id")
+	assert.Equal([]cqrs.Event{suiteEvent{"an_id", 1}, suiteEvent{"an_id", 2}}, cqrs.Events(events))
+}
+
+func testRoundTrip(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+	nested := suiteNested{Label: "a label", Values: []int{1, 2, 3}}
+	event := suiteFieldsEvent{
+		Id:      "an_id",
+		String:  "a string with \"quotes\", unicode ✓ and a\nnewline",
+		Int:     -42,
+		Int64:   1<<53 + 1,
+		Uint:    42,
+		Float:   3.25,
+		Bool:    true,
+		Time:    time.Date(2020, time.February, 29, 12, 30, 15, 123456789, time.UTC),
+		Bytes:   []byte{0, 1, 2, 255},
+		Strings: []string{"a", "", "c"},
+		Map:     map[string]int{"one": 1, "two": 2},
+		Nested:  nested,
+		Pointer: &nested,
+	}
+
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, wrap(event, suiteFieldsEvent{Id: "an_id"})))
+
+	events, err := es.Load(context.Background(), "an_id")
+	assert.Nil(err)
+	assert.Equal([]cqrs.Event{event, suiteFieldsEvent{Id: "an_id"}}, cqrs.Events(events))
+}
+
+func testSerializationFailure(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+
+	err := es.Persist(context.Background(), "an_id", 0, wrap(suiteEvent{"an_id", 1}, suiteUnserializableEvent{"an_id", suiteUnserializable{"a value"}}))
+
+	assert.True(errors.Is(err, cqrs.ErrSerialization))
+	_, err = es.Load(context.Background(), "an_id")
+	assert.True(errors.Is(err, cqrs.ErrStreamNotFound))
+}
+
+func testEnvelopeMetadata(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+	metadata := cqrs.Metadata{CausationId: "a_causation_id", CorrelationId: "a_correlation_id", Headers: map[string]string{"user": "a user"}}
+	envelopes := cqrs.NewEventEnvelopes([]cqrs.Event{suiteEvent{"an_id", 1}, suiteEvent{"an_id", 2}}, metadata)
+	assert.Nil(es.Persist(context.Background(), "another_id", 0, wrap(suiteEvent{"another_id", 1})))
+
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, envelopes))
+
+	// the envelopes passed in are stamped with what the store assigned them
+	assert.Equal(1, envelopes[0].Sequence)
+	assert.Equal(2, envelopes[1].Sequence)
+	assert.Equal(int64(2), envelopes[0].Position)
+	assert.Equal(int64(3), envelopes[1].Position)
+	events, err := es.Load(context.Background(), "an_id")
+	assert.Nil(err)
+	for i, event := range events {
+		assert.Equal(envelopes[i].EventId, event.EventId)
+		assert.Equal("an_id", event.AggregateId)
+		assert.Equal(envelopes[i].Sequence, event.Sequence)
+		assert.Equal(envelopes[i].Position, event.Position)
+		assert.True(envelopes[i].Timestamp.Equal(event.Timestamp))
+		assert.Equal(metadata.CausationId, event.CausationId)
+		assert.Equal(metadata.CorrelationId, event.CorrelationId)
+		assert.Equal(metadata.Headers, event.Headers)
+	}
+}
+
+func testGlobalPositions(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, wrap(suiteEvent{"an_id", 1})))
+	assert.Nil(es.Persist(context.Background(), "another_id", 0, wrap(suiteEvent{"another_id", 1}, suiteEvent{"another_id", 2})))
+	assert.Nil(es.Persist(context.Background(), "an_id", 1, wrap(suiteEvent{"an_id", 2})))
+
+	events, err := es.ReadAll(context.Background(), 0, 0)
+
+	assert.Nil(err)
+	assert.Equal([]cqrs.Event{suiteEvent{"an_id", 1}, suiteEvent{"another_id", 1}, suiteEvent{"another_id", 2}, suiteEvent{"an_id", 2}}, cqrs.Events(events))
+	for i, event := range events {
+		assert.Equal(int64(i+1), event.Position)
+	}
+	events, _ = es.ReadAll(context.Background(), 1, 2)
+	assert.Equal([]cqrs.Event{suiteEvent{"another_id", 1}, suiteEvent{"another_id", 2}}, cqrs.Events(events))
+	events, _ = es.ReadAll(context.Background(), 4, 0)
+	assert.Equal(0, len(events))
+	position, _ := es.LastPosition(context.Background())
+	assert.Equal(int64(4), position)
+}
+
+func testPublishing(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	eventBus := components.NewEventBus()
+	listener := &suiteListener{}
+	eventBus.RegisterQueryEventHandlers(listener)
+	es := newStore(t, eventBus)
+	envelopes := wrap(suiteEvent{"an_id", 1}, suiteEvent{"an_id", 2})
+
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, envelopes))
+	assert.NotNil(es.Persist(context.Background(), "an_id", 0, wrap(suiteEvent{"an_id", 3})))
+
+	published := listener.published()
+	assert.Equal(2, len(published))
+	for i, envelope := range published {
+		assert.Equal(envelopes[i].EventId, envelope.EventId)
+		assert.Equal(i+1, envelope.Sequence)
+		assert.Equal(int64(i+1), envelope.Position)
+	}
+}
+
+func testCancelledContext(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	eventBus := components.NewEventBus()
+	listener := &suiteListener{}
+	eventBus.RegisterQueryEventHandlers(listener)
+	es := newStore(t, eventBus)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.True(errors.Is(es.Persist(ctx, "an_id", 0, wrap(suiteEvent{"an_id", 1})), context.Canceled))
+	assert.Equal(0, len(listener.published()))
+	_, err := es.Load(context.Background(), "an_id")
+	assert.True(errors.Is(err, cqrs.ErrStreamNotFound))
+	assert.Nil(es.Persist(context.Background(), "an_id", 0, wrap(suiteEvent{"an_id", 1})))
+	_, err = es.Load(ctx, "an_id")
+	assert.True(errors.Is(err, context.Canceled))
+}
+
+func testConcurrentWriters(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+	const writers, eventsPerWriter = 8, 25
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := fmt.Sprintf("writer_%d", w)
+			for i := 0; i < eventsPerWriter; i++ {
+				assert.Nil(es.Persist(context.Background(), id, i, wrap(suiteEvent{id, i + 1})))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	positions := make(map[int64]bool)
+	for w := 0; w < writers; w++ {
+		events, err := es.Load(context.Background(), fmt.Sprintf("writer_%d", w))
+		assert.Nil(err)
+		assert.Equal(eventsPerWriter, len(events))
+		for i, event := range events {
+			assert.Equal(i+1, event.Sequence)
+			assert.Equal(i+1, event.Event.(suiteEvent).Number)
+			positions[event.Position] = true
+		}
+	}
+	assert.Equal(writers*eventsPerWriter, len(positions))
+	events, _ := es.ReadAll(context.Background(), 0, 0)
+	assert.Equal(writers*eventsPerWriter, len(events))
+}
+
+// testConcurrentWritersToOneStream has writers race for the next version of a single stream, each
+// retrying on conflicts, and checks that no write is lost or duplicated.
+func testConcurrentWritersToOneStream(t *testing.T, newStore EventStoreFactory) {
+	assert := assert.New(t)
+	es := newStore(t, components.NewEventBus())
+	const writers, eventsPerWriter = 4, 10
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for written := 0; written < eventsPerWriter; {
+				events, err := es.Load(context.Background(), "an_id")
+				if err != nil && !errors.Is(err, cqrs.ErrStreamNotFound) {
+					assert.Nil(err)
+					return
+				}
+				err = es.Persist(context.Background(), "an_id", len(events), wrap(suiteEvent{"an_id", len(events) + 1}))
+				if err == nil {
+					written++
+				} else if !errors.Is(err, cqrs.ErrConcurrencyConflict) {
+					assert.Nil(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	events, err := es.Load(context.Background(), "an_id")
+	assert.Nil(err)
+	assert.Equal(writers*eventsPerWriter, len(events))
+	for i, event := range events {
+		assert.Equal(i+1, event.Sequence)
+		assert.Equal(i+1, event.Event.(suiteEvent).Number)
+	}
+}
+
+func wrap(events ...cqrs.Event) []*cqrs.EventEnvelope {
+	return cqrs.NewEventEnvelopes(events, cqrs.Metadata{})
+}
+
+type suiteEvent struct {
+	Id     string
+	Number int
+}
+
+func (e suiteEvent) AggregateId() string { return e.Id }
+
+type suiteOtherEvent struct {
+	Id   string
+	Name string
+}
+
+func (e suiteOtherEvent) AggregateId() string { return e.Id }
+
+type suiteNested struct {
+	Label  string
+	Values []int
+}
+
+type suiteFieldsEvent struct {
+	Id      string
+	String  string
+	Int     int
+	Int64   int64
+	Uint    uint32
+	Float   float64
+	Bool    bool
+	Time    time.Time
+	Bytes   []byte
+	Strings []string
+	Map     map[string]int
+	Nested  suiteNested
+	Pointer *suiteNested
+}
+
+func (e suiteFieldsEvent) AggregateId() string { return e.Id }
+
+type suiteUnserializableEvent struct {
+	Id    string
+	Value suiteUnserializable
+}
+
+func (e suiteUnserializableEvent) AggregateId() string { return e.Id }
+
+var errUnserializable = errors.New("not serializable")
+
+// suiteUnserializable fails to marshal both as JSON and through encoding.BinaryMarshaler, which covers the
+// encodings of the serializers in package persist. Its value must not be zero, as zero fields may be
+// left out of the encoding altogether.
+type suiteUnserializable struct {
+	Value string
+}
+
+func (suiteUnserializable) MarshalJSON() ([]byte, error)       { return nil, errUnserializable }
+func (*suiteUnserializable) UnmarshalJSON(data []byte) error   { return errUnserializable }
+func (suiteUnserializable) MarshalBinary() ([]byte, error)     { return nil, errUnserializable }
+func (*suiteUnserializable) UnmarshalBinary(data []byte) error { return errUnserializable }
+
+type suiteListener struct {
+	mu        sync.Mutex
+	envelopes []*cqrs.EventEnvelope
+}
+
+func (l *suiteListener) OnSuiteEvent(e suiteEvent, envelope *cqrs.EventEnvelope) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.envelopes = append(l.envelopes, envelope)
+}
+
+func (l *suiteListener) published() []*cqrs.EventEnvelope {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*cqrs.EventEnvelope{}, l.envelopes...)
+}
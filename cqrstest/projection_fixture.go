@@ -0,0 +1,92 @@
+package cqrstest
+
+import (
+	"context"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/components"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ProjectionFixture feeds events straight into a query listener through a SynchronousEventBus, without
+// a gateway or event store, and checks the read model it builds:
+//
+//	view := NewOrderView()
+//	cqrstest.NewProjectionFixture(t, view).
+//		Given(OrderPlaced{Id: "an_order"}, OrderPaid{Id: "an_order"}).
+//		ExpectState(func() interface{} { return view.Order("an_order").Status }, "paid").
+//		ExpectIdempotent(func() interface{} { return view.Orders() })
+//
+// Events get consecutive positions and per-aggregate sequence numbers as if they had been persisted.
+// Errors and panics of the listener fail the test.
+type ProjectionFixture struct {
+	t         testing.TB
+	listener  interface{}
+	eventBus  *components.SynchronousEventBus
+	delivered []*cqrs.EventEnvelope
+	sequencer *sequencer
+}
+
+func NewProjectionFixture(t testing.TB, listener interface{}) *ProjectionFixture {
+	eventBus := components.NewEventBus()
+	eventBus.RegisterQueryEventHandlers(listener)
+	return &ProjectionFixture{t: t, listener: listener, eventBus: eventBus, sequencer: newSequencer()}
+}
+
+// Given delivers the events to the listener in order. It may be called more than once.
+func (fixture *ProjectionFixture) Given(events ...cqrs.Event) *ProjectionFixture {
+	fixture.t.Helper()
+	envelopes := cqrs.NewEventEnvelopes(events, cqrs.Metadata{})
+	fixture.sequencer.stamp(envelopes)
+	fixture.delivered = append(fixture.delivered, envelopes...)
+	fixture.publish(envelopes)
+	return fixture
+}
+
+// GivenEnvelopes delivers the envelopes as they are, for listeners that depend on their metadata.
+func (fixture *ProjectionFixture) GivenEnvelopes(envelopes ...*cqrs.EventEnvelope) *ProjectionFixture {
+	fixture.t.Helper()
+	fixture.delivered = append(fixture.delivered, envelopes...)
+	fixture.publish(envelopes)
+	return fixture
+}
+
+// ExpectState checks the value returned by state, typically a part of the read model, against the
+// expected one.
+func (fixture *ProjectionFixture) ExpectState(state func() interface{}, expected interface{}) *ProjectionFixture {
+	fixture.t.Helper()
+	assert.Equal(fixture.t, expected, state())
+	return fixture
+}
+
+// ExpectIdempotent delivers every event given so far a second time and checks that the value returned
+// by state, which should cover the whole read model, did not change. Listeners must tolerate duplicates,
+// which reach them whenever they are replayed from an older checkpoint.
+func (fixture *ProjectionFixture) ExpectIdempotent(state func() interface{}) *ProjectionFixture {
+	fixture.t.Helper()
+	before := stateDumper.Sdump(state())
+	fixture.publish(fixture.delivered)
+	if after := stateDumper.Sdump(state()); after != before {
+		fixture.t.Errorf("%T is not idempotent, delivering its events again changed the read model:\n%s", fixture.listener, diff(before, after))
+	}
+	return fixture
+}
+
+func (fixture *ProjectionFixture) publish(envelopes []*cqrs.EventEnvelope) {
+	fixture.t.Helper()
+	ctx := context.Background()
+	if err := fixture.eventBus.PublishEvents(ctx, envelopes); err != nil {
+		fixture.t.Fatalf("events could not be delivered: %v", err)
+		return
+	}
+	letters, err := fixture.eventBus.DeadLetters().List(ctx)
+	if err != nil {
+		fixture.t.Fatalf("dead letters could not be listed: %v", err)
+		return
+	}
+	for _, letter := range letters {
+		fixture.t.Errorf("%s failed to handle %T at position %d: %s", letter.Listener, letter.Envelope.Event, letter.Envelope.Position, letter.Error)
+		fixture.eventBus.DeadLetters().Remove(ctx, letter.Id)
+	}
+}
@@ -0,0 +1,95 @@
+package cqrstest
+
+import (
+	"errors"
+	"github.com/davegarred/cqrs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProjectionFixture_expectState(t *testing.T) {
+	view := newBalanceView(true)
+
+	NewProjectionFixture(t, view).
+		Given(accountOpened{accountId}, deposited{accountId, 10}, deposited{"another_id", 3}).
+		Given(withdrawn{accountId, 4}).
+		ExpectState(func() interface{} { return view.balances[accountId] }, 6).
+		ExpectState(func() interface{} { return view.sequences }, map[string]int{accountId: 3, "another_id": 1}).
+		ExpectIdempotent(func() interface{} { return view.balances })
+}
+
+func TestProjectionFixture_detectsDuplicateSensitiveListener(t *testing.T) {
+	recorder := &recordingT{TB: t}
+	view := newBalanceView(false)
+
+	NewProjectionFixture(recorder, view).
+		Given(accountOpened{accountId}, deposited{accountId, 10}).
+		ExpectIdempotent(func() interface{} { return view.balances })
+
+	assert.Equal(t, 1, len(recorder.failures))
+	assert.Contains(t, recorder.failures[0], "is not idempotent")
+	assert.Contains(t, recorder.failures[0], "+  (string) (len=13) \"an_account_id\": (int) 20")
+}
+
+func TestProjectionFixture_reportsListenerErrors(t *testing.T) {
+	recorder := &recordingT{TB: t}
+
+	NewProjectionFixture(recorder, &failingView{}).
+		Given(accountOpened{accountId}, deposited{accountId, 10})
+
+	assert.Equal(t, 1, len(recorder.failures))
+	assert.Contains(t, recorder.failures[0], "OnDeposited failed to handle cqrstest.deposited at position 2: a view failure")
+}
+
+func TestProjectionFixture_givenEnvelopes(t *testing.T) {
+	view := newBalanceView(true)
+	envelope := cqrs.NewEventEnvelope(deposited{accountId, 10}, cqrs.Metadata{})
+	envelope.Sequence = 7
+
+	NewProjectionFixture(t, view).
+		GivenEnvelopes(envelope).
+		ExpectState(func() interface{} { return view.sequences[accountId] }, 7)
+}
+
+// balanceView keeps account balances. When deduplicating it ignores events it has already seen, by
+// their sequence within the account.
+type balanceView struct {
+	deduplicate bool
+	balances    map[string]int
+	sequences   map[string]int
+}
+
+func newBalanceView(deduplicate bool) *balanceView {
+	return &balanceView{deduplicate: deduplicate, balances: make(map[string]int), sequences: make(map[string]int)}
+}
+
+func (v *balanceView) OnDeposited(e deposited, envelope *cqrs.EventEnvelope) {
+	if v.seen(envelope) {
+		return
+	}
+	v.balances[e.Id] += e.Amount
+}
+func (v *balanceView) OnWithdrawn(e withdrawn, envelope *cqrs.EventEnvelope) {
+	if v.seen(envelope) {
+		return
+	}
+	v.balances[e.Id] -= e.Amount
+}
+func (v *balanceView) OnAccountOpened(e accountOpened, envelope *cqrs.EventEnvelope) {
+	v.seen(envelope)
+}
+
+func (v *balanceView) seen(envelope *cqrs.EventEnvelope) bool {
+	if v.deduplicate && envelope.Sequence <= v.sequences[envelope.AggregateId] {
+		return true
+	}
+	v.sequences[envelope.AggregateId] = envelope.Sequence
+	return false
+}
+
+type failingView struct{}
+
+func (*failingView) OnDeposited(e deposited) error {
+	return errors.New("a view failure")
+}
@@ -0,0 +1,267 @@
+package cqrstest
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/components"
+	"github.com/davegarred/cqrs/persist"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// SagaFixtureEpoch is the time the fake clock of a SagaFixture starts at.
+var SagaFixtureEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var farFuture = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// SagaFixture runs a saga against in-memory stores, records the commands it dispatches instead of
+// handling them and lets time pass on a fake clock:
+//
+//	cqrstest.NewSagaFixture(t, &PaymentSaga{}).
+//		Given(OrderPlaced{Id: "an_order"}).
+//		ExpectScheduledEvent(72*time.Hour, PaymentDeadline{Id: "an_order"}).
+//		WhenTimeElapses(72*time.Hour).
+//		ExpectCommands(CancelOrder{Id: "an_order"})
+//
+// Expectations apply to what happened since the last Given, When or WhenTimeElapses, except for the
+// scheduled deadlines, which are those still pending.
+type SagaFixture struct {
+	t         testing.TB
+	sagaType  string
+	clock     *components.FakeClock
+	manager   *components.SagaManager
+	scheduler *components.Scheduler
+	schedules *persist.MemScheduleStore
+	sagas     *persist.MemSagaStore
+	commands  *commandRecorder
+	sequencer *sequencer
+	err       error
+}
+
+func NewSagaFixture(t testing.TB, saga interface{}) *SagaFixture {
+	t.Helper()
+	fixture := &SagaFixture{
+		t:         t,
+		clock:     components.NewFakeClock(SagaFixtureEpoch),
+		schedules: persist.NewMemScheduleStore(),
+		sagas:     persist.NewMemSagaStore(),
+		commands:  &commandRecorder{},
+		sequencer: newSequencer(),
+	}
+	fixture.manager = components.NewSagaManager(fixture.commands, fixture.sagas)
+	fixture.scheduler = components.NewScheduler(fixture.schedules, fixture.clock, fixture.commands, &sagaEventBus{fixture.manager})
+	fixture.manager.SetScheduler(fixture.scheduler)
+	if err := fixture.manager.RegisterSaga(saga); err != nil {
+		t.Fatalf("saga %T could not be registered: %v", saga, err)
+		return fixture
+	}
+	fixture.sagaType = components.SagaTypeName(saga)
+	return fixture
+}
+
+// Clock returns the fake clock that deadlines are measured against.
+func (fixture *SagaFixture) Clock() *components.FakeClock {
+	return fixture.clock
+}
+
+// Given delivers past events to the saga, which must handle them without error.
+func (fixture *SagaFixture) Given(events ...cqrs.Event) *SagaFixture {
+	fixture.t.Helper()
+	fixture.commands.reset()
+	if err := fixture.deliver(events); err != nil {
+		fixture.t.Fatalf("given events could not be handled: %v", err)
+	}
+	return fixture
+}
+
+// When delivers the events to the saga, recording the commands it dispatches and any error.
+func (fixture *SagaFixture) When(events ...cqrs.Event) *SagaFixture {
+	fixture.commands.reset()
+	fixture.err = fixture.deliver(events)
+	return fixture
+}
+
+// WhenTimeElapses advances the clock and delivers the deadlines that fall due, dispatching scheduled
+// commands to the recorder and scheduled events to the saga.
+func (fixture *SagaFixture) WhenTimeElapses(d time.Duration) *SagaFixture {
+	fixture.commands.reset()
+	fixture.clock.Advance(d)
+	_, fixture.err = fixture.scheduler.FireDue(context.Background())
+	return fixture
+}
+
+// ExpectCommands checks that exactly the commands were dispatched, in order.
+func (fixture *SagaFixture) ExpectCommands(commands ...cqrs.Command) *SagaFixture {
+	fixture.t.Helper()
+	if fixture.err != nil {
+		fixture.t.Errorf("expected commands, but the saga failed: %v", fixture.err)
+		return fixture
+	}
+	if commands == nil {
+		commands = []cqrs.Command{}
+	}
+	assert.Equal(fixture.t, commands, fixture.commands.recorded())
+	return fixture
+}
+
+func (fixture *SagaFixture) ExpectNoCommands() *SagaFixture {
+	fixture.t.Helper()
+	return fixture.ExpectCommands()
+}
+
+// ExpectError checks that the saga failed with an error matching target as reported by errors.Is.
+func (fixture *SagaFixture) ExpectError(target error) *SagaFixture {
+	fixture.t.Helper()
+	if !errors.Is(fixture.err, target) {
+		fixture.t.Errorf("expected error %v, but the saga returned: %v", target, fixture.err)
+	}
+	return fixture
+}
+
+// ExpectScheduledEvent checks that a deadline event is pending, due after the delay from now.
+func (fixture *SagaFixture) ExpectScheduledEvent(delay time.Duration, event cqrs.Event) *SagaFixture {
+	fixture.t.Helper()
+	fixture.expectScheduled(delay, cqrs.ScheduledMessage{Event: event})
+	return fixture
+}
+
+// ExpectScheduledCommand checks that a command is pending, due after the delay from now.
+func (fixture *SagaFixture) ExpectScheduledCommand(delay time.Duration, command cqrs.Command) *SagaFixture {
+	fixture.t.Helper()
+	fixture.expectScheduled(delay, cqrs.ScheduledMessage{Command: command})
+	return fixture
+}
+
+func (fixture *SagaFixture) ExpectNoScheduled() *SagaFixture {
+	fixture.t.Helper()
+	if pending := fixture.pending(); len(pending) > 0 {
+		fixture.t.Errorf("expected nothing to be scheduled, but found:\n%s", stateDumper.Sdump(pending))
+	}
+	return fixture
+}
+
+// ExpectActive checks that a saga instance is associated with the value.
+func (fixture *SagaFixture) ExpectActive(association string) *SagaFixture {
+	fixture.t.Helper()
+	if len(fixture.instances(association)) == 0 {
+		fixture.t.Errorf("expected a saga associated with %q, but there is none", association)
+	}
+	return fixture
+}
+
+// ExpectEnded checks that no saga instance is associated with the value any more, or never was.
+func (fixture *SagaFixture) ExpectEnded(association string) *SagaFixture {
+	fixture.t.Helper()
+	if instances := fixture.instances(association); len(instances) > 0 {
+		fixture.t.Errorf("expected no saga associated with %q, but found %d", association, len(instances))
+	}
+	return fixture
+}
+
+func (fixture *SagaFixture) deliver(events []cqrs.Event) error {
+	envelopes := cqrs.NewEventEnvelopes(events, cqrs.Metadata{})
+	fixture.sequencer.stamp(envelopes)
+	for _, envelope := range envelopes {
+		if err := fixture.manager.HandleEvent(context.Background(), envelope.Event, envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fixture *SagaFixture) expectScheduled(delay time.Duration, expected cqrs.ScheduledMessage) {
+	fixture.t.Helper()
+	due := fixture.clock.Now().Add(delay)
+	pending := fixture.pending()
+	for _, message := range pending {
+		if message.Due.Equal(due) && reflect.DeepEqual(message.Command, expected.Command) && reflect.DeepEqual(message.Event, expected.Event) {
+			return
+		}
+	}
+	var value interface{} = expected.Event
+	if expected.Command != nil {
+		value = expected.Command
+	}
+	fixture.t.Errorf("expected %T due at %v to be scheduled, but found:\n%s", value, due, stateDumper.Sdump(pending))
+}
+
+func (fixture *SagaFixture) pending() []cqrs.ScheduledMessage {
+	fixture.t.Helper()
+	pending, err := fixture.schedules.DueSchedules(context.Background(), farFuture)
+	if err != nil {
+		fixture.t.Fatalf("scheduled messages could not be listed: %v", err)
+	}
+	return pending
+}
+
+func (fixture *SagaFixture) instances(association string) []cqrs.SagaState {
+	fixture.t.Helper()
+	instances, err := fixture.sagas.FindSagas(context.Background(), fixture.sagaType, association)
+	if err != nil {
+		fixture.t.Fatalf("sagas could not be listed: %v", err)
+	}
+	return instances
+}
+
+// commandRecorder stands in for the CommandGateway.
+type commandRecorder struct {
+	mu       sync.Mutex
+	commands []cqrs.Command
+}
+
+func (recorder *commandRecorder) DispatchContext(ctx context.Context, command cqrs.Command) error {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.commands = append(recorder.commands, command)
+	return nil
+}
+
+func (recorder *commandRecorder) reset() {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.commands = nil
+}
+
+func (recorder *commandRecorder) recorded() []cqrs.Command {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return append([]cqrs.Command{}, recorder.commands...)
+}
+
+// sagaEventBus hands deadline events straight to the saga manager.
+type sagaEventBus struct {
+	manager *components.SagaManager
+}
+
+func (eventBus *sagaEventBus) PublishEvents(ctx context.Context, events []*cqrs.EventEnvelope) error {
+	for _, envelope := range events {
+		if err := eventBus.manager.HandleEvent(ctx, envelope.Event, envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequencer numbers events as an event store would, with per-aggregate sequences and global positions.
+type sequencer struct {
+	sequences map[string]int
+	position  int64
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{sequences: make(map[string]int)}
+}
+
+func (s *sequencer) stamp(envelopes []*cqrs.EventEnvelope) {
+	for _, envelope := range envelopes {
+		s.sequences[envelope.AggregateId]++
+		s.position++
+		envelope.Sequence = s.sequences[envelope.AggregateId]
+		envelope.Position = s.position
+	}
+}
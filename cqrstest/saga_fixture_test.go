@@ -0,0 +1,156 @@
+package cqrstest
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/components"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	orderId        = "an_order_id"
+	reminderDelay  = 24 * time.Hour
+	paymentTimeout = 72 * time.Hour
+)
+
+var errUnknownCustomer = errors.New("unknown customer")
+
+func TestSagaFixture_deadlineExpires(t *testing.T) {
+	NewSagaFixture(t, &paymentSaga{}).
+		Given(orderPlaced{orderId, "a customer"}).
+		ExpectScheduledCommand(reminderDelay, sendReminder{orderId}).
+		ExpectScheduledEvent(paymentTimeout, paymentDeadline{orderId}).
+		ExpectActive(orderId).
+		WhenTimeElapses(reminderDelay).
+		ExpectCommands(sendReminder{orderId}).
+		ExpectScheduledEvent(paymentTimeout-reminderDelay, paymentDeadline{orderId}).
+		WhenTimeElapses(paymentTimeout - reminderDelay).
+		ExpectCommands(cancelOrder{orderId}).
+		ExpectNoScheduled().
+		ExpectEnded(orderId)
+}
+
+func TestSagaFixture_paidInTime(t *testing.T) {
+	NewSagaFixture(t, &paymentSaga{}).
+		Given(orderPlaced{orderId, "a customer"}).
+		When(orderPaid{orderId}).
+		ExpectCommands(shipOrder{orderId}).
+		ExpectNoScheduled().
+		ExpectEnded(orderId).
+		WhenTimeElapses(paymentTimeout).
+		ExpectNoCommands()
+}
+
+func TestSagaFixture_expectError(t *testing.T) {
+	NewSagaFixture(t, &paymentSaga{}).
+		When(orderPlaced{orderId, ""}).
+		ExpectError(errUnknownCustomer).
+		ExpectEnded(orderId)
+}
+
+func TestSagaFixture_reportsMismatches(t *testing.T) {
+	recorder := &recordingT{TB: t}
+
+	NewSagaFixture(recorder, &paymentSaga{}).
+		Given(orderPlaced{orderId, "a customer"}).
+		ExpectScheduledEvent(reminderDelay, paymentDeadline{orderId}).
+		ExpectNoScheduled().
+		When(orderPaid{"another_order_id"}).
+		ExpectCommands(shipOrder{orderId}).
+		ExpectEnded(orderId).
+		When(orderPlaced{"another_order_id", ""}).
+		ExpectNoCommands()
+
+	assert.Equal(t, 5, len(recorder.failures))
+	assert.Contains(t, recorder.failures[0], "expected cqrstest.paymentDeadline due at 2000-01-02")
+	assert.Contains(t, recorder.failures[1], "expected nothing to be scheduled")
+	assert.Contains(t, recorder.failures[2], "shipOrder")
+	assert.Contains(t, recorder.failures[3], "expected no saga associated with \"an_order_id\"")
+	assert.Contains(t, recorder.failures[4], "unknown customer")
+}
+
+func TestSagaFixture_registerWithoutLifecycle(t *testing.T) {
+	recorder := &recordingT{TB: t}
+
+	NewSagaFixture(recorder, &balanceView{})
+
+	assert.Equal(t, 1, len(recorder.failures))
+}
+
+// paymentSaga reminds the customer of an unpaid order after a day and cancels it after three.
+type paymentSaga struct {
+	components.SagaLifecycle
+	ReminderId string
+	DeadlineId string
+}
+
+func (s *paymentSaga) StartOnOrderPlaced(ctx context.Context, e orderPlaced) ([]cqrs.Command, error) {
+	if e.Customer == "" {
+		s.End()
+		return nil, errUnknownCustomer
+	}
+	scheduler := components.SchedulerFromContext(ctx)
+	now := scheduler.Clock().Now()
+	var err error
+	if s.ReminderId, err = scheduler.ScheduleCommand(ctx, now.Add(reminderDelay), sendReminder{e.Id}); err != nil {
+		return nil, err
+	}
+	s.DeadlineId, err = scheduler.ScheduleEvent(ctx, now.Add(paymentTimeout), paymentDeadline{e.Id})
+	return nil, err
+}
+func (s *paymentSaga) OnOrderPaid(ctx context.Context, e orderPaid) ([]cqrs.Command, error) {
+	scheduler := components.SchedulerFromContext(ctx)
+	if err := scheduler.Cancel(ctx, s.ReminderId); err != nil {
+		return nil, err
+	}
+	if err := scheduler.Cancel(ctx, s.DeadlineId); err != nil {
+		return nil, err
+	}
+	s.End()
+	return []cqrs.Command{shipOrder{e.Id}}, nil
+}
+func (s *paymentSaga) OnPaymentDeadline(e paymentDeadline) ([]cqrs.Command, error) {
+	s.End()
+	return []cqrs.Command{cancelOrder{e.Id}}, nil
+}
+
+type orderPlaced struct {
+	Id       string
+	Customer string
+}
+
+func (e orderPlaced) AggregateId() string { return e.Id }
+
+type orderPaid struct {
+	Id string
+}
+
+func (e orderPaid) AggregateId() string { return e.Id }
+
+type paymentDeadline struct {
+	Id string
+}
+
+func (e paymentDeadline) AggregateId() string { return e.Id }
+
+type sendReminder struct {
+	Id string
+}
+
+func (c sendReminder) TargetAggregateId() string { return c.Id }
+
+type shipOrder struct {
+	Id string
+}
+
+func (c shipOrder) TargetAggregateId() string { return c.Id }
+
+type cancelOrder struct {
+	Id string
+}
+
+func (c cancelOrder) TargetAggregateId() string { return c.Id }
@@ -1,10 +1,12 @@
 package e2e
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/davegarred/cqrs"
 	"github.com/davegarred/cqrs/components"
+	"github.com/davegarred/cqrs/cqrstest"
 	"github.com/davegarred/cqrs/persist"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -34,7 +36,7 @@ func TestCommandGateway_foo(t *testing.T) {
 	err := commandGateway.Dispatch(nameFoo)
 	assert.Nil(t, err)
 
-	assert.Equal(t, 2, len(eventStore.Load(createFoo.Id)))
+	assert.Equal(t, 2, len(loadCleanly(eventStore, createFoo.Id)))
 }
 
 func TestCommandGateway_bar(t *testing.T) {
@@ -47,7 +49,7 @@ func TestCommandGateway_bar(t *testing.T) {
 	dispatchCleanly(commandGateway, createBar)
 	dispatchCleanly(commandGateway, configureBar)
 
-	assert.Equal(t, 2, len(eventStore.Load(createBar.Id)))
+	assert.Equal(t, 2, len(loadCleanly(eventStore, createBar.Id)))
 }
 
 func TestCombinedCommandGateways(t *testing.T) {
@@ -65,14 +67,47 @@ func TestCombinedCommandGateways(t *testing.T) {
 	dispatchCleanly(commandGateway, configureBar)
 
 	fmt.Println("Published events:")
-	for _, event := range eventStore.Load(createBar.Id) {
-		fmt.Printf("\t- %+v\n", event)
+	for _, event := range loadCleanly(eventStore, createBar.Id) {
+		fmt.Printf("\t- %d %+v\n", event.Position, event.Event)
 	}
-	for _, event := range eventStore.Load(createFoo.Id) {
-		fmt.Printf("\t- %+v\n", event)
+	for _, event := range loadCleanly(eventStore, createFoo.Id) {
+		fmt.Printf("\t- %d %+v\n", event.Position, event.Event)
 	}
 }
 
+func TestProjectionRebuild(t *testing.T) {
+	eventBus := components.NewEventBus()
+	eventStore := persist.NewMemEventStore(eventBus)
+	commandGateway := components.NewCommandGateway(eventStore)
+	commandGateway.RegisterAggregate(&fooAggregate{})
+	commandGateway.RegisterAggregate(&barAggregate{})
+	dispatchCleanly(commandGateway, createFoo)
+	dispatchCleanly(commandGateway, nameFoo)
+	dispatchCleanly(commandGateway, createBar)
+
+	runner := components.NewProjectionRunner(eventStore, eventBus)
+	defer runner.Close()
+	assert.Nil(t, runner.Register(context.Background(), "foobar", &fooBarEventListener{}))
+	queryMap[fooId] = fooBarQuery{Id: fooId, Name: "a corrupted name"}
+
+	assert.Nil(t, runner.Rebuild(context.Background(), "foobar"))
+	dispatchCleanly(commandGateway, configureBar)
+
+	assert.Equal(t, fooBarQuery{Id: fooId, Type: "Foo", Name: "a name"}, queryMap[fooId])
+	assert.Equal(t, fooBarQuery{Id: barId, Type: "Bar", Configuration: "a configuration"}, queryMap[barId])
+}
+
+func TestFooBarEventListener(t *testing.T) {
+	listener := &fooBarEventListener{}
+	listener.Reset(context.Background())
+
+	cqrstest.NewProjectionFixture(t, listener).
+		Given(fooCreatedEvent{fooId}, fooNamedEvent{fooId, "a name"}, barCreatedEvent{barId}, barConfiguredEvent{barId, "a configuration"}).
+		ExpectState(func() interface{} { return queryMap[fooId] }, fooBarQuery{Id: fooId, Type: "Foo", Name: "a name"}).
+		ExpectState(func() interface{} { return queryMap[barId] }, fooBarQuery{Id: barId, Type: "Bar", Configuration: "a configuration"}).
+		ExpectIdempotent(func() interface{} { return queryMap })
+}
+
 func dispatchCleanly(commandGateway *components.CommandGateway, c cqrs.Command) error {
 	err := commandGateway.Dispatch(c)
 	if err != nil {
@@ -81,6 +116,14 @@ func dispatchCleanly(commandGateway *components.CommandGateway, c cqrs.Command)
 	return nil
 }
 
+func loadCleanly(eventStore cqrs.EventStore, aggregateId string) []*cqrs.EventEnvelope {
+	events, err := eventStore.Load(context.Background(), aggregateId)
+	if err != nil {
+		panic(err)
+	}
+	return events
+}
+
 
 type fooAggregate struct {
 	fooId string
@@ -98,7 +141,6 @@ func (a *fooAggregate) NonCQRSFunction_twoParams(_ string, _ int) {
 }
 func (a *fooAggregate) NonCQRSFunction_oneParam_similarSig(_ string) ([]string, error) {
 	panic("This should never be called")
-	return nil, nil
 }
 func (a *fooAggregate) HandleCreateFoo(e createFooCommand) ([]cqrs.Event, error) {
 	return []cqrs.Event{fooCreatedEvent{e.Id}}, nil
@@ -209,6 +251,10 @@ type fooBarQuery struct {
 
 type fooBarEventListener struct{}
 
+func (*fooBarEventListener) Reset(ctx context.Context) error {
+	queryMap = make(map[string]fooBarQuery)
+	return nil
+}
 func (*fooBarEventListener) OnBarCreated(e barCreatedEvent) {
 	q := fooBarQuery{}
 	q.Id = e.Id
@@ -0,0 +1,68 @@
+package cqrs
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// Metadata travels with a command and is copied onto every event the command produces.
+type Metadata struct {
+	CausationId   string
+	CorrelationId string
+	Headers       map[string]string
+}
+
+// EventEnvelope wraps a persisted event. EventId, Timestamp and the metadata fields are set when the
+// envelope is created; Sequence (1-based within the aggregate's stream) and Position (1-based across
+// the whole store) are assigned by the EventStore when the event is persisted.
+type EventEnvelope struct {
+	EventId       string
+	AggregateId   string
+	Sequence      int
+	Position      int64
+	Timestamp     time.Time
+	CausationId   string
+	CorrelationId string
+	Headers       map[string]string
+	Event         Event
+}
+
+func NewEventEnvelope(event Event, metadata Metadata) *EventEnvelope {
+	return &EventEnvelope{
+		EventId:       NewId(),
+		AggregateId:   event.AggregateId(),
+		Timestamp:     time.Now().UTC(),
+		CausationId:   metadata.CausationId,
+		CorrelationId: metadata.CorrelationId,
+		Headers:       metadata.Headers,
+		Event:         event,
+	}
+}
+
+func NewEventEnvelopes(events []Event, metadata Metadata) []*EventEnvelope {
+	envelopes := make([]*EventEnvelope, len(events))
+	for i, event := range events {
+		envelopes[i] = NewEventEnvelope(event, metadata)
+	}
+	return envelopes
+}
+
+func Events(envelopes []*EventEnvelope) []Event {
+	events := make([]Event, len(envelopes))
+	for i, envelope := range envelopes {
+		events[i] = envelope.Event
+	}
+	return events
+}
+
+// NewId returns a random (version 4) UUID.
+func NewId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,31 @@
+package cqrs
+
+import (
+	"errors"
+	"fmt"
+)
+
+const AnyVersion = -1
+
+var (
+	ErrConcurrencyConflict = errors.New("concurrency conflict")
+	ErrSerialization       = errors.New("event serialization failure")
+	ErrStreamNotFound      = errors.New("event stream not found")
+	ErrMisconfiguration    = errors.New("misconfiguration")
+	ErrSnapshotNotFound    = errors.New("snapshot not found")
+	ErrEventBusClosed      = errors.New("event bus is shut down")
+)
+
+type ConcurrencyError struct {
+	AggregateId     string
+	ExpectedVersion int
+	ActualVersion   int
+}
+
+func (e *ConcurrencyError) Error() string {
+	return fmt.Sprintf("concurrency conflict on aggregate %s: expected version %d but stream is at version %d", e.AggregateId, e.ExpectedVersion, e.ActualVersion)
+}
+
+func (e *ConcurrencyError) Is(target error) bool {
+	return target == ErrConcurrencyConflict
+}
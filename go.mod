@@ -1,7 +1,9 @@
 module github.com/davegarred/cqrs
 
+go 1.27.1
+
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/davecgh/go-spew v1.1.1
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/stretchr/testify v1.2.2
 )
@@ -1,5 +1,7 @@
 package cqrs
 
+import "context"
+
 type Command interface {
 	TargetAggregateId() string
 }
@@ -9,10 +11,18 @@ type Event interface {
 }
 
 type EventStore interface {
-	Persist(aggregateId string, events []Event)
-	Load(aggregateId string) []Event
+	Persist(ctx context.Context, aggregateId string, expectedVersion int, events []*EventEnvelope) error
+	Load(ctx context.Context, aggregateId string) ([]*EventEnvelope, error)
+	// LoadFrom returns the events of a stream with a sequence number greater than afterVersion.
+	LoadFrom(ctx context.Context, aggregateId string, afterVersion int) ([]*EventEnvelope, error)
+	// ReadAll returns up to limit events of all streams with a position greater than fromPosition, in
+	// commit order. Passing the position of the last event handled resumes right after it; a limit of
+	// zero or less returns every remaining event.
+	ReadAll(ctx context.Context, fromPosition int64, limit int) ([]*EventEnvelope, error)
+	// LastPosition returns the position of the most recently committed event, or 0 for an empty store.
+	LastPosition(ctx context.Context) (int64, error)
 }
 
 type EventBus interface {
-	PublishEvents(events []Event)
-}
\ No newline at end of file
+	PublishEvents(ctx context.Context, events []*EventEnvelope) error
+}
@@ -0,0 +1,29 @@
+// Package testhooks lets the fixtures of package cqrstest observe package components at points that are
+// not part of its API.
+package testhooks
+
+import (
+	"context"
+	"github.com/davegarred/cqrs"
+)
+
+type handlerObserverKey struct{}
+
+// HandlerObserver is told about every command handler call along with the aggregate it is applied to,
+// for fixtures that need to inspect the aggregate itself rather than the events it produces.
+type HandlerObserver interface {
+	BeforeCommand(aggregate interface{}, command cqrs.Command)
+	AfterCommand(aggregate interface{}, command cqrs.Command, events []cqrs.Event, err error)
+}
+
+// ContextWithHandlerObserver makes the observer see the handler calls of the commands dispatched with the
+// context, including those dispatched by synchronous listeners of their events.
+func ContextWithHandlerObserver(ctx context.Context, observer HandlerObserver) context.Context {
+	return context.WithValue(ctx, handlerObserverKey{}, observer)
+}
+
+// HandlerObserverFromContext returns the observer attached to the context, or nil.
+func HandlerObserverFromContext(ctx context.Context) HandlerObserver {
+	observer, _ := ctx.Value(handlerObserverKey{}).(HandlerObserver)
+	return observer
+}
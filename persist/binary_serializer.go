@@ -0,0 +1,333 @@
+package persist
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var (
+	errTruncated          = errors.New("binary payload is truncated")
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// BinarySerializer is a compact, protobuf-style codec. Exported struct fields are keyed by their
+// position in the struct and zero values are omitted, so fields may be appended to an event type
+// without invalidating payloads that were written before the change. A nil pointer is written as
+// empty data, which no other pointer encodes to.
+type BinarySerializer struct{}
+
+func (BinarySerializer) ContentType() string { return ContentTypeBinary }
+
+func (BinarySerializer) Marshal(value interface{}) ([]byte, error) {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return nil, errors.New("cannot encode a nil value")
+	}
+	if wireType(v.Type()) == wireBytes {
+		return appendInner(nil, v)
+	}
+	return appendElement(nil, v)
+}
+
+func (BinarySerializer) Unmarshal(data []byte, valueType reflect.Type) (interface{}, error) {
+	target := reflect.New(valueType).Elem()
+	var err error
+	if wireType(valueType) == wireBytes {
+		err = decodeInner(data, target)
+	} else {
+		r := &binaryReader{data: data}
+		err = decodeElement(r, wireType(valueType), target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return target.Interface(), nil
+}
+
+func wireType(t reflect.Type) int {
+	if isBinaryMarshaler(t) {
+		return wireBytes
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return wireVarint
+	case reflect.Float64:
+		return wireFixed64
+	case reflect.Float32:
+		return wireFixed32
+	default:
+		return wireBytes
+	}
+}
+
+func isBinaryMarshaler(t reflect.Type) bool {
+	return t.Implements(binaryMarshalerType) && reflect.PtrTo(t).Implements(binaryUnmarshalerType)
+}
+
+func appendElement(buf []byte, v reflect.Value) ([]byte, error) {
+	switch wireType(v.Type()) {
+	case wireVarint:
+		switch v.Kind() {
+		case reflect.Bool:
+			if v.Bool() {
+				return binary.AppendUvarint(buf, 1), nil
+			}
+			return binary.AppendUvarint(buf, 0), nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return binary.AppendVarint(buf, v.Int()), nil
+		default:
+			return binary.AppendUvarint(buf, v.Uint()), nil
+		}
+	case wireFixed64:
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case wireFixed32:
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+	}
+	inner, err := appendInner(nil, v)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(inner)))
+	return append(buf, inner...), nil
+}
+
+func appendInner(buf []byte, v reflect.Value) ([]byte, error) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return buf, nil
+	}
+	if isBinaryMarshaler(v.Type()) {
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		return append(buf, data...), err
+	}
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		return append(buf, v.String()...), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(buf, v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		for i := 0; i < v.Len() && err == nil; i++ {
+			buf, err = appendElement(buf, v.Index(i))
+		}
+		return buf, err
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() && err == nil {
+			if buf, err = appendElement(buf, iter.Key()); err == nil {
+				buf, err = appendElement(buf, iter.Value())
+			}
+		}
+		return buf, err
+	case reflect.Ptr:
+		return appendElement(buf, v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField() && err == nil; i++ {
+			field := v.Field(i)
+			if v.Type().Field(i).PkgPath != "" || field.IsZero() {
+				continue
+			}
+			buf = binary.AppendUvarint(buf, uint64(i+1)<<3|uint64(wireType(field.Type())))
+			buf, err = appendElement(buf, field)
+		}
+		return buf, err
+	}
+	return nil, fmt.Errorf("unsupported kind %v", v.Kind())
+}
+
+type binaryReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *binaryReader) done() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *binaryReader) uvarint() (uint64, error) {
+	value, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.pos += n
+	return value, nil
+}
+
+func (r *binaryReader) varint() (int64, error) {
+	value, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.pos += n
+	return value, nil
+}
+
+func (r *binaryReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, errTruncated
+	}
+	chunk := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return chunk, nil
+}
+
+func (r *binaryReader) skip(wire int) error {
+	var err error
+	switch wire {
+	case wireVarint:
+		_, err = r.uvarint()
+	case wireFixed64:
+		_, err = r.next(8)
+	case wireFixed32:
+		_, err = r.next(4)
+	case wireBytes:
+		var length uint64
+		if length, err = r.uvarint(); err == nil {
+			_, err = r.next(int(length))
+		}
+	default:
+		err = fmt.Errorf("unknown wire type %d", wire)
+	}
+	return err
+}
+
+func decodeElement(r *binaryReader, wire int, v reflect.Value) error {
+	if wire != wireType(v.Type()) {
+		return fmt.Errorf("wire type %d cannot be decoded into %v", wire, v.Type())
+	}
+	switch wire {
+	case wireVarint:
+		switch v.Kind() {
+		case reflect.Bool:
+			value, err := r.uvarint()
+			v.SetBool(value != 0)
+			return err
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			value, err := r.varint()
+			v.SetInt(value)
+			return err
+		default:
+			value, err := r.uvarint()
+			v.SetUint(value)
+			return err
+		}
+	case wireFixed64:
+		chunk, err := r.next(8)
+		if err == nil {
+			v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(chunk)))
+		}
+		return err
+	case wireFixed32:
+		chunk, err := r.next(4)
+		if err == nil {
+			v.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(chunk))))
+		}
+		return err
+	}
+	length, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	chunk, err := r.next(int(length))
+	if err != nil {
+		return err
+	}
+	return decodeInner(chunk, v)
+}
+
+func decodeInner(data []byte, v reflect.Value) error {
+	if isBinaryMarshaler(v.Type()) {
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+	r := &binaryReader{data: data}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(data))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte{}, data...))
+			return nil
+		}
+		elemWire := wireType(v.Type().Elem())
+		slice := reflect.MakeSlice(v.Type(), 0, 0)
+		for !r.done() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeElement(r, elemWire, elem); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Array:
+		elemWire := wireType(v.Type().Elem())
+		for i := 0; i < v.Len() && !r.done(); i++ {
+			if err := decodeElement(r, elemWire, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		keyWire, valueWire := wireType(v.Type().Key()), wireType(v.Type().Elem())
+		for !r.done() {
+			key := reflect.New(v.Type().Key()).Elem()
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeElement(r, keyWire, key); err != nil {
+				return err
+			}
+			if err := decodeElement(r, valueWire, value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Ptr:
+		if len(data) == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeElement(r, wireType(v.Type().Elem()), elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Struct:
+		for !r.done() {
+			key, err := r.uvarint()
+			if err != nil {
+				return err
+			}
+			index, wire := int(key>>3)-1, int(key&7)
+			if index < 0 || index >= v.NumField() || v.Type().Field(index).PkgPath != "" || wireType(v.Field(index).Type()) != wire {
+				if err := r.skip(wire); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := decodeElement(r, wire, v.Field(index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported kind %v", v.Kind())
+}
@@ -0,0 +1,91 @@
+package persist
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const checkpointExtension = ".checkpoint"
+
+type MemCheckpointStore struct {
+	mu          sync.RWMutex
+	checkpoints map[string]int64
+}
+
+func NewMemCheckpointStore() *MemCheckpointStore {
+	return &MemCheckpointStore{checkpoints: make(map[string]int64)}
+}
+
+func (s *MemCheckpointStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[name] = position
+	return nil
+}
+
+func (s *MemCheckpointStore) LoadCheckpoint(ctx context.Context, name string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkpoints[name], nil
+}
+
+// FileCheckpointStore keeps each checkpoint in its own file, replaced atomically on every save.
+type FileCheckpointStore struct {
+	dir string
+}
+
+type fileCheckpoint struct {
+	Position int64 `json:"position"`
+}
+
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileCheckpointStore{dir: dir}, nil
+}
+
+func (s *FileCheckpointStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(fileCheckpoint{position})
+	if err != nil {
+		return fmt.Errorf("%w: %v", cqrs.ErrSerialization, err)
+	}
+	return writeFileAtomic(s.path(name), payload)
+}
+
+func (s *FileCheckpointStore) LoadCheckpoint(ctx context.Context, name string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	payload, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var checkpoint fileCheckpoint
+	if err := json.Unmarshal(payload, &checkpoint); err != nil {
+		return 0, fmt.Errorf("%w: checkpoint of %s: %v", cqrs.ErrSerialization, name, err)
+	}
+	return checkpoint.Position, nil
+}
+
+func (s *FileCheckpointStore) path(name string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(name))+checkpointExtension)
+}
@@ -0,0 +1,59 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, NewMemCheckpointStore())
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	store, err := NewFileCheckpointStore(t.TempDir())
+	assert.Nil(t, err)
+	testCheckpointStore(t, store)
+}
+
+func testCheckpointStore(t *testing.T, store cqrs.CheckpointStore) {
+	assert := assert.New(t)
+	position, err := store.LoadCheckpoint(context.Background(), "a_processor")
+	assert.Nil(err)
+	assert.Equal(int64(0), position)
+
+	assert.Nil(store.SaveCheckpoint(context.Background(), "a_processor", 3))
+	assert.Nil(store.SaveCheckpoint(context.Background(), "a_processor", 7))
+	assert.Nil(store.SaveCheckpoint(context.Background(), "another/processor", 2))
+
+	position, err = store.LoadCheckpoint(context.Background(), "a_processor")
+	assert.Nil(err)
+	assert.Equal(int64(7), position)
+	position, _ = store.LoadCheckpoint(context.Background(), "another/processor")
+	assert.Equal(int64(2), position)
+}
+
+func TestFileCheckpointStore_reopen(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileCheckpointStore(dir)
+	assert.Nil(t, store.SaveCheckpoint(context.Background(), "a_processor", 5))
+
+	store, _ = NewFileCheckpointStore(dir)
+	position, err := store.LoadCheckpoint(context.Background(), "a_processor")
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), position)
+}
+
+func TestFileCheckpointStore_corrupt(t *testing.T) {
+	store, _ := NewFileCheckpointStore(t.TempDir())
+	assert.Nil(t, os.WriteFile(store.path("a_processor"), []byte("{"), 0644))
+
+	_, err := store.LoadCheckpoint(context.Background(), "a_processor")
+
+	assert.True(t, errors.Is(err, cqrs.ErrSerialization))
+}
@@ -0,0 +1,40 @@
+package persist_test
+
+import (
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/cqrstest"
+	"github.com/davegarred/cqrs/persist"
+	"testing"
+)
+
+var serializers = []persist.Serializer{
+	persist.JSONSerializer{},
+	persist.GobSerializer{},
+	persist.BinarySerializer{},
+	persist.MessagePackSerializer{},
+}
+
+func TestMemEventStore_conformance(t *testing.T) {
+	for _, serializer := range serializers {
+		t.Run(serializer.ContentType(), func(t *testing.T) {
+			cqrstest.RunEventStoreSuite(t, func(t *testing.T, eventBus cqrs.EventBus) cqrs.EventStore {
+				return persist.NewMemEventStore(eventBus, persist.WithSerializer(serializer))
+			})
+		})
+	}
+}
+
+func TestFileEventStore_conformance(t *testing.T) {
+	for _, serializer := range serializers {
+		t.Run(serializer.ContentType(), func(t *testing.T) {
+			cqrstest.RunEventStoreSuite(t, func(t *testing.T, eventBus cqrs.EventBus) cqrs.EventStore {
+				es, err := persist.NewFileEventStore(t.TempDir(), eventBus, persist.WithSerializer(serializer))
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { es.Close() })
+				return es
+			})
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package persist
+
+import "os"
+
+// lockDir does not lock on this platform; the caller must make sure that only one store uses dir.
+func lockDir(dir string) (*os.File, error) {
+	return nil, nil
+}
+
+// syncDir does nothing on this platform, where directories cannot be opened for syncing.
+func syncDir(dir string) error {
+	return nil
+}
@@ -1,56 +1,211 @@
 package persist
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/davegarred/cqrs"
-	"reflect"
+	"sync"
+	"time"
 )
 
 type MemEventStore struct {
+	mu       sync.RWMutex
 	eventBus cqrs.EventBus
+	options  options
 	eventMap map[string][]StoredEvent
+	log      []StoredEvent
 }
 
+// StoredEvent is the serialized form of an event. The envelope metadata is kept as is, with the event
+// itself replaced by its type name, content type and payload.
 type StoredEvent struct {
-	eventType reflect.Type
-	payload   []byte
+	eventType   string
+	contentType string
+	payload     []byte
+	metadata    cqrs.EventEnvelope
 }
 
-func (s *MemEventStore) Persist(aggregateId string, newEvents []cqrs.Event) {
+func (s *MemEventStore) Persist(ctx context.Context, aggregateId string, expectedVersion int, newEvents []*cqrs.EventEnvelope) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	storedEvents, err := serializeAll(s.options, newEvents)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
 	events := s.eventMap[aggregateId]
-	if events == nil {
-		events = make([]StoredEvent, 0)
+	if expectedVersion != cqrs.AnyVersion && expectedVersion != len(events) {
+		s.mu.Unlock()
+		return &cqrs.ConcurrencyError{AggregateId: aggregateId, ExpectedVersion: expectedVersion, ActualVersion: len(events)}
+	}
+	if len(newEvents) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	for i, envelope := range newEvents {
+		stamp(envelope, aggregateId, len(events)+i+1, int64(len(s.log)+i+1))
+		storedEvents[i].setMetadata(envelope)
+	}
+	s.eventMap[aggregateId] = append(events, storedEvents...)
+	s.log = append(s.log, storedEvents...)
+	s.mu.Unlock()
+
+	return publish(ctx, s.eventBus, newEvents)
+}
+
+func (s *MemEventStore) Load(ctx context.Context, aggregateId string) ([]*cqrs.EventEnvelope, error) {
+	return s.LoadFrom(ctx, aggregateId, 0)
+}
+
+func (s *MemEventStore) LoadFrom(ctx context.Context, aggregateId string, afterVersion int) ([]*cqrs.EventEnvelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	storedEvents, ok := s.eventMap[aggregateId]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", cqrs.ErrStreamNotFound, aggregateId)
 	}
-	for _, event := range newEvents {
-		events = append(events, serialize(event))
+	if afterVersion > len(storedEvents) {
+		afterVersion = len(storedEvents)
 	}
-	s.eventMap[aggregateId] = events
-	s.eventBus.PublishEvents(newEvents)
+	if afterVersion > 0 {
+		storedEvents = storedEvents[afterVersion:]
+	}
+	events := make([]*cqrs.EventEnvelope, len(storedEvents))
+	for i, storedEvent := range storedEvents {
+		event, err := deserialize(s.options, storedEvent)
+		if err != nil {
+			return nil, err
+		}
+		events[i] = event
+	}
+	return events, nil
 }
 
-func (s *MemEventStore) Load(aggregateId string) []cqrs.Event {
-	storedEvents := s.eventMap[aggregateId]
-	events := make([]cqrs.Event, len(storedEvents))
+func (s *MemEventStore) ReadAll(ctx context.Context, fromPosition int64, limit int) ([]*cqrs.EventEnvelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	storedEvents := s.log[logIndex(fromPosition, len(s.log)):]
+	s.mu.RUnlock()
+	if limit > 0 && len(storedEvents) > limit {
+		storedEvents = storedEvents[:limit]
+	}
+	events := make([]*cqrs.EventEnvelope, len(storedEvents))
 	for i, storedEvent := range storedEvents {
-		event := reflect.New(storedEvent.eventType).Interface().(cqrs.Event)
-		err := json.Unmarshal(storedEvent.payload, event)
+		event, err := deserialize(s.options, storedEvent)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		events[i] = reflect.ValueOf(event).Elem().Interface().(cqrs.Event)
+		events[i] = event
 	}
-	return events
+	return events, nil
 }
 
-func NewMemEventStore(eventBus cqrs.EventBus) cqrs.EventStore {
-	return &MemEventStore{eventBus, make(map[string][]StoredEvent)}
+func (s *MemEventStore) LastPosition(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.log)), nil
+}
+
+func NewMemEventStore(eventBus cqrs.EventBus, opts ...Option) cqrs.EventStore {
+	return &MemEventStore{eventBus: eventBus, options: newOptions(opts), eventMap: make(map[string][]StoredEvent)}
+}
+
+// publish hands committed events to the event bus. The events are durable by now, so delivery is not
+// abandoned when the caller's context is cancelled, and a bus that has been shut down does not fail the
+// command that produced them; they remain in the store for readers catching up from it. Stores publish
+// without holding their own locks so that listeners may read from or write to the store; events of
+// concurrent writers to different streams may therefore reach the bus in a different order than their
+// positions.
+func publish(ctx context.Context, eventBus cqrs.EventBus, events []*cqrs.EventEnvelope) error {
+	if err := eventBus.PublishEvents(context.WithoutCancel(ctx), events); err != nil && !errors.Is(err, cqrs.ErrEventBusClosed) {
+		return err
+	}
+	return nil
 }
 
-func serialize(event cqrs.Event) StoredEvent {
-	eventType := reflect.TypeOf(event)
-	payload, err := json.Marshal(event)
+// logIndex returns the index into a store's global log of the first event after fromPosition. Positions
+// are assigned without gaps starting at 1, so the event at position p is at index p-1.
+func logIndex(fromPosition int64, length int) int {
+	if fromPosition < 0 {
+		return 0
+	}
+	if fromPosition > int64(length) {
+		return length
+	}
+	return int(fromPosition)
+}
+
+// stamp completes an envelope with the values that only the store can assign.
+func stamp(envelope *cqrs.EventEnvelope, aggregateId string, sequence int, position int64) {
+	envelope.AggregateId = aggregateId
+	envelope.Sequence = sequence
+	envelope.Position = position
+	if envelope.EventId == "" {
+		envelope.EventId = cqrs.NewId()
+	}
+	if envelope.Timestamp.IsZero() {
+		envelope.Timestamp = time.Now().UTC()
+	}
+}
+
+func (storedEvent *StoredEvent) setMetadata(envelope *cqrs.EventEnvelope) {
+	storedEvent.metadata = *envelope
+	storedEvent.metadata.Event = nil
+}
+
+func serializeAll(o options, envelopes []*cqrs.EventEnvelope) ([]StoredEvent, error) {
+	storedEvents := make([]StoredEvent, len(envelopes))
+	for i, envelope := range envelopes {
+		storedEvent, err := serialize(o, envelope.Event)
+		if err != nil {
+			return nil, err
+		}
+		storedEvents[i] = storedEvent
+	}
+	return storedEvents, nil
+}
+
+func serialize(o options, event cqrs.Event) (StoredEvent, error) {
+	eventType, err := o.registry.NameOf(event)
+	if err != nil {
+		return StoredEvent{}, err
+	}
+	payload, err := o.serializer.Marshal(event)
+	if err != nil {
+		return StoredEvent{}, fmt.Errorf("%w: %T: %v", cqrs.ErrSerialization, event, err)
+	}
+	return StoredEvent{eventType: eventType, contentType: o.serializer.ContentType(), payload: payload}, nil
+}
+
+func deserialize(o options, storedEvent StoredEvent) (*cqrs.EventEnvelope, error) {
+	eventType, err := o.registry.TypeOf(storedEvent.eventType)
+	if err != nil {
+		return nil, err
+	}
+	serializer, ok := o.serializers[storedEvent.contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: no serializer for content type %q", cqrs.ErrSerialization, storedEvent.contentType)
+	}
+	value, err := serializer.Unmarshal(storedEvent.payload, eventType)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v: %v", cqrs.ErrSerialization, eventType, err)
+	}
+	event, ok := value.(cqrs.Event)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v does not implement cqrs.Event", cqrs.ErrSerialization, eventType)
 	}
-	return StoredEvent{eventType, payload}
+	envelope := storedEvent.metadata
+	envelope.Event = event
+	return &envelope, nil
 }
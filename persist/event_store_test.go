@@ -1,6 +1,7 @@
 package persist
 
 import (
+	"context"
 	"github.com/davegarred/cqrs"
 	"github.com/davegarred/cqrs/components"
 	"testing"
@@ -8,6 +9,9 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// The contract shared by the event stores of this package is checked by cqrstest.RunEventStoreSuite in
+// conformance_test.go; the tests of this package cover what is specific to each store.
+
 const aggregateId = "aggregate_id"
 
 func TestNewMemEventStore(t *testing.T) {
@@ -19,16 +23,21 @@ func TestNewMemEventStore(t *testing.T) {
 	event1 := eventBusTestEvent1{aggregateId}
 	event2 := eventBusTestEvent2{aggregateId, "a name"}
 
-	es.Persist(aggregateId, []cqrs.Event{event1, event2})
+	assert.Nil(es.Persist(context.Background(), aggregateId, 0, wrap(event1, event2)))
 
-	events := es.Load(aggregateId)
+	events, err := es.Load(context.Background(), aggregateId)
+	assert.Nil(err)
 	assert.Equal(2, len(events))
-	assert.Equal(event1, events[0])
-	assert.Equal(event2, events[1])
+	assert.Equal(event1, events[0].Event)
+	assert.Equal(event2, events[1].Event)
 	assert.True(listener.foundEvent1)
 	assert.True(listener.foundEvent2)
 }
 
+func wrap(events ...cqrs.Event) []*cqrs.EventEnvelope {
+	return cqrs.NewEventEnvelopes(events, cqrs.Metadata{})
+}
+
 type eventBusTestEvent1 struct {
 	Id string
 }
@@ -0,0 +1,511 @@
+package persist
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentSize = 64 << 20
+	recordHeaderSize   = 8
+	segmentExtension   = ".log"
+)
+
+var (
+	ErrCorruptSegment = errors.New("corrupt event log segment")
+	ErrStoreClosed    = errors.New("event store is closed")
+	ErrStoreLocked    = errors.New("event store directory is in use by another process")
+	crcTable          = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the active segment to stable storage before Persist returns.
+	SyncAlways SyncPolicy = iota
+	// SyncOnRotate flushes a segment only when it is sealed and when the store is closed.
+	SyncOnRotate
+	// SyncNone leaves flushing entirely to the operating system.
+	SyncNone
+)
+
+// FileEventStore keeps every Persist call as a single checksummed record in a series of append-only
+// segment files. Only record locations are held in memory; events are read back from disk on Load.
+// The store holds an exclusive lock on its directory until it is closed, so that no other process
+// appends to the same segments.
+type FileEventStore struct {
+	mu       sync.RWMutex
+	dir      string
+	lock     *os.File
+	closed   bool
+	eventBus cqrs.EventBus
+	options  options
+	segments []*segment
+	index    map[string][]eventLocation
+	log      []eventLocation
+	position int64
+}
+
+type segment struct {
+	id   int
+	file *os.File
+	size int64
+}
+
+type eventLocation struct {
+	segment int
+	offset  int64
+	index   int
+}
+
+type fileRecord struct {
+	AggregateId string            `json:"aggregateId"`
+	Events      []fileRecordEvent `json:"events"`
+}
+
+type fileRecordEvent struct {
+	EventId       string            `json:"eventId"`
+	Sequence      int               `json:"sequence"`
+	Position      int64             `json:"position"`
+	Timestamp     time.Time         `json:"timestamp"`
+	CausationId   string            `json:"causationId,omitempty"`
+	CorrelationId string            `json:"correlationId,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Type          string            `json:"type"`
+	ContentType   string            `json:"contentType"`
+	Payload       []byte            `json:"payload"`
+}
+
+func NewFileEventStore(dir string, eventBus cqrs.EventBus, opts ...Option) (*FileEventStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileEventStore{
+		dir:      dir,
+		eventBus: eventBus,
+		options:  newOptions(opts),
+		index:    make(map[string][]eventLocation),
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.lock = lock
+	if err := s.open(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileEventStore) Persist(ctx context.Context, aggregateId string, expectedVersion int, newEvents []*cqrs.EventEnvelope) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.append(aggregateId, expectedVersion, newEvents); err != nil {
+		return err
+	}
+	return publish(ctx, s.eventBus, newEvents)
+}
+
+func (s *FileEventStore) append(aggregateId string, expectedVersion int, newEvents []*cqrs.EventEnvelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	current := len(s.index[aggregateId])
+	if expectedVersion != cqrs.AnyVersion && expectedVersion != current {
+		return &cqrs.ConcurrencyError{AggregateId: aggregateId, ExpectedVersion: expectedVersion, ActualVersion: current}
+	}
+	if len(newEvents) == 0 {
+		return nil
+	}
+
+	storedEvents, err := serializeAll(s.options, newEvents)
+	if err != nil {
+		return err
+	}
+	record := fileRecord{AggregateId: aggregateId, Events: make([]fileRecordEvent, len(newEvents))}
+	for i, envelope := range newEvents {
+		stamped := *envelope
+		stamp(&stamped, aggregateId, current+i+1, s.position+int64(i)+1)
+		storedEvents[i].setMetadata(&stamped)
+		record.Events[i] = newFileRecordEvent(storedEvents[i])
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cqrs.ErrSerialization, err)
+	}
+
+	active, err := s.activeSegment(int64(recordHeaderSize + len(payload)))
+	if err != nil {
+		return err
+	}
+	offset, err := active.append(payload)
+	if err != nil {
+		return err
+	}
+	if s.options.syncPolicy == SyncAlways {
+		if err := active.file.Sync(); err != nil {
+			return err
+		}
+	}
+	s.indexRecord(active.id, offset, record)
+	for i, envelope := range newEvents {
+		event := envelope.Event
+		*envelope = storedEvents[i].metadata
+		envelope.Event = event
+	}
+	return nil
+}
+
+func (s *FileEventStore) Load(ctx context.Context, aggregateId string) ([]*cqrs.EventEnvelope, error) {
+	return s.LoadFrom(ctx, aggregateId, 0)
+}
+
+func (s *FileEventStore) LoadFrom(ctx context.Context, aggregateId string, afterVersion int) ([]*cqrs.EventEnvelope, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	locations, ok := s.index[aggregateId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", cqrs.ErrStreamNotFound, aggregateId)
+	}
+	if afterVersion > len(locations) {
+		afterVersion = len(locations)
+	}
+	if afterVersion > 0 {
+		locations = locations[afterVersion:]
+	}
+	return s.readLocations(ctx, locations)
+}
+
+func (s *FileEventStore) ReadAll(ctx context.Context, fromPosition int64, limit int) ([]*cqrs.EventEnvelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	locations := s.log[logIndex(fromPosition, len(s.log)):]
+	if limit > 0 && len(locations) > limit {
+		locations = locations[:limit]
+	}
+	return s.readLocations(ctx, locations)
+}
+
+func (s *FileEventStore) LastPosition(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.position, nil
+}
+
+// readLocations reads the events at the given locations, reading each record only once for consecutive
+// events written together. The caller must hold the read lock.
+func (s *FileEventStore) readLocations(ctx context.Context, locations []eventLocation) ([]*cqrs.EventEnvelope, error) {
+	events := make([]*cqrs.EventEnvelope, len(locations))
+	var record fileRecord
+	var recordAt *eventLocation
+	for i := range locations {
+		location := &locations[i]
+		if recordAt == nil || recordAt.segment != location.segment || recordAt.offset != location.offset {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			var err error
+			if record, err = s.readRecord(location); err != nil {
+				return nil, err
+			}
+			recordAt = location
+		}
+		event, err := deserialize(s.options, record.Events[location.index].storedEvent(record.AggregateId))
+		if err != nil {
+			return nil, err
+		}
+		events[i] = event
+	}
+	return events, nil
+}
+
+// Close flushes and closes the segments and releases the directory. Calls to the store after Close
+// fail with ErrStoreClosed.
+func (s *FileEventStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var firstErr error
+	for _, seg := range s.segments {
+		if s.options.syncPolicy != SyncNone {
+			if err := seg.file.Sync(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.segments = nil
+	if s.lock != nil {
+		if err := s.lock.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *FileEventStore) open() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentExtension))
+	if err != nil {
+		return err
+	}
+	ids := make([]int, 0, len(paths))
+	for _, path := range paths {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(path), "%08d"+segmentExtension, &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for i, id := range ids {
+		seg, err := s.openSegment(id)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		if err := s.recoverSegment(seg, i == len(ids)-1); err != nil {
+			return err
+		}
+	}
+	if len(s.segments) == 0 {
+		seg, err := s.createSegment(0)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	return nil
+}
+
+// recoverSegment rebuilds the index from a segment. A damaged record that runs to the end of the last
+// segment is the result of a torn write and is truncated; damage anywhere else, including a damaged
+// record followed by more data, is reported as corruption rather than dropping the records after it.
+func (s *FileEventStore) recoverSegment(seg *segment, last bool) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	var offset int64
+	for offset < fileSize {
+		payload, err := readRecordAt(seg.file, offset, fileSize)
+		var record fileRecord
+		if err == nil {
+			if jsonErr := json.Unmarshal(payload, &record); jsonErr != nil {
+				err = fmt.Errorf("%w: %v", ErrCorruptSegment, jsonErr)
+			}
+		}
+		if err != nil {
+			if !last || !errors.Is(err, ErrCorruptSegment) || !reachesEnd(seg.file, offset, fileSize) {
+				return fmt.Errorf("segment %d at offset %d: %w", seg.id, offset, err)
+			}
+			if err := seg.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		s.indexRecord(seg.id, offset, record)
+		offset += int64(recordHeaderSize + len(payload))
+	}
+	seg.size = offset
+	return nil
+}
+
+func (s *FileEventStore) indexRecord(segmentId int, offset int64, record fileRecord) {
+	for i, recordEvent := range record.Events {
+		s.index[record.AggregateId] = append(s.index[record.AggregateId], eventLocation{segmentId, offset, i})
+		s.log = append(s.log, eventLocation{segmentId, offset, i})
+		if recordEvent.Position > s.position {
+			s.position = recordEvent.Position
+		}
+	}
+}
+
+func (s *FileEventStore) readRecord(location *eventLocation) (fileRecord, error) {
+	var record fileRecord
+	seg := s.segment(location.segment)
+	if seg == nil {
+		return record, fmt.Errorf("%w: segment %d is missing", ErrCorruptSegment, location.segment)
+	}
+	payload, err := readRecordAt(seg.file, location.offset, seg.size)
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, fmt.Errorf("%w: %v", ErrCorruptSegment, err)
+	}
+	return record, nil
+}
+
+func (s *FileEventStore) segment(id int) *segment {
+	for _, seg := range s.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (s *FileEventStore) activeSegment(recordSize int64) (*segment, error) {
+	active := s.segments[len(s.segments)-1]
+	if active.size == 0 || active.size+recordSize <= s.options.segmentSize {
+		return active, nil
+	}
+	if s.options.syncPolicy == SyncOnRotate {
+		if err := active.file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	next, err := s.createSegment(active.id + 1)
+	if err != nil {
+		return nil, err
+	}
+	s.segments = append(s.segments, next)
+	return next, nil
+}
+
+// createSegment opens a new segment and, unless the sync policy leaves flushing to the operating system,
+// makes its directory entry durable so that the segment cannot vanish in a crash after records went into it.
+func (s *FileEventStore) createSegment(id int) (*segment, error) {
+	seg, err := s.openSegment(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.options.syncPolicy != SyncNone {
+		if err := syncDir(s.dir); err != nil {
+			seg.file.Close()
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+func (s *FileEventStore) openSegment(id int) (*segment, error) {
+	path := filepath.Join(s.dir, fmt.Sprintf("%08d"+segmentExtension, id))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{id: id, file: file}, nil
+}
+
+func newFileRecordEvent(storedEvent StoredEvent) fileRecordEvent {
+	metadata := storedEvent.metadata
+	return fileRecordEvent{
+		EventId:       metadata.EventId,
+		Sequence:      metadata.Sequence,
+		Position:      metadata.Position,
+		Timestamp:     metadata.Timestamp,
+		CausationId:   metadata.CausationId,
+		CorrelationId: metadata.CorrelationId,
+		Headers:       metadata.Headers,
+		Type:          storedEvent.eventType,
+		ContentType:   storedEvent.contentType,
+		Payload:       storedEvent.payload,
+	}
+}
+
+func (e fileRecordEvent) storedEvent(aggregateId string) StoredEvent {
+	return StoredEvent{
+		eventType:   e.Type,
+		contentType: e.ContentType,
+		payload:     e.Payload,
+		metadata: cqrs.EventEnvelope{
+			EventId:       e.EventId,
+			AggregateId:   aggregateId,
+			Sequence:      e.Sequence,
+			Position:      e.Position,
+			Timestamp:     e.Timestamp,
+			CausationId:   e.CausationId,
+			CorrelationId: e.CorrelationId,
+			Headers:       e.Headers,
+		},
+	}
+}
+
+func (seg *segment) append(payload []byte) (int64, error) {
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[recordHeaderSize:], payload)
+
+	offset := seg.size
+	if _, err := seg.file.WriteAt(buf, offset); err != nil {
+		seg.file.Truncate(offset)
+		return 0, err
+	}
+	seg.size += int64(len(buf))
+	return offset, nil
+}
+
+// reachesEnd reports whether the record at offset, as far as its header can be read, extends to the end of
+// the file, which only the record written last can do.
+func reachesEnd(file *os.File, offset int64, size int64) bool {
+	if size-offset < recordHeaderSize {
+		return true
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return false
+	}
+	return offset+recordHeaderSize+int64(binary.BigEndian.Uint32(header[0:4])) >= size
+}
+
+func readRecordAt(file *os.File, offset int64, limit int64) ([]byte, error) {
+	if limit-offset < recordHeaderSize {
+		return nil, fmt.Errorf("%w: truncated record header", ErrCorruptSegment)
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if limit-offset-recordHeaderSize < length {
+		return nil, fmt.Errorf("%w: truncated record payload", ErrCorruptSegment)
+	}
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, offset+recordHeaderSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSegment)
+	}
+	return payload, nil
+}
@@ -0,0 +1,156 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/components"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileEventStore_reopen(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	event1 := eventBusTestEvent1{aggregateId}
+	event2 := eventBusTestEvent2{aggregateId, "a name"}
+	es, err := NewFileEventStore(dir, components.NewEventBus(), WithTypeRegistry(NewTypeRegistry()))
+	assert.Nil(err)
+	assert.Nil(es.Persist(context.Background(), aggregateId, 0, wrap(event1)))
+	assert.Nil(es.Persist(context.Background(), aggregateId, 1, wrap(event2)))
+	assert.Nil(es.Close())
+
+	registry := NewTypeRegistry()
+	es, err = NewFileEventStore(dir, components.NewEventBus(), WithTypeRegistry(registry))
+	assert.Nil(err)
+	defer es.Close()
+	_, err = es.Load(context.Background(), aggregateId)
+	assert.True(errors.Is(err, cqrs.ErrSerialization))
+
+	assert.Nil(registry.Register(eventBusTestEvent1{}))
+	assert.Nil(registry.Register(eventBusTestEvent2{}))
+	events, err := es.Load(context.Background(), aggregateId)
+	assert.Nil(err)
+	assert.Equal([]cqrs.Event{event1, event2}, cqrs.Events(events))
+	assert.True(errors.Is(es.Persist(context.Background(), aggregateId, 1, wrap(event1)), cqrs.ErrConcurrencyConflict))
+
+	envelopes := wrap(event1)
+	assert.Nil(es.Persist(context.Background(), aggregateId, 2, envelopes))
+	assert.Equal(3, envelopes[0].Sequence)
+	assert.Equal(int64(3), envelopes[0].Position)
+}
+
+func TestFileEventStore_segmentRotation(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	es, err := NewFileEventStore(dir, components.NewEventBus(), WithSegmentSize(64), WithSyncPolicy(SyncOnRotate))
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(es.Persist(context.Background(), aggregateId, i, wrap(eventBusTestEvent2{aggregateId, "a name"})))
+	}
+	assert.Nil(es.Close())
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	assert.Equal(5, len(segments))
+
+	es, err = NewFileEventStore(dir, components.NewEventBus(), WithSegmentSize(64))
+	assert.Nil(err)
+	defer es.Close()
+	events, err := es.Load(context.Background(), aggregateId)
+	assert.Nil(err)
+	assert.Equal(5, len(events))
+	events, err = es.ReadAll(context.Background(), 2, 2)
+	assert.Nil(err)
+	assert.Equal([]int64{3, 4}, []int64{events[0].Position, events[1].Position})
+}
+
+func TestFileEventStore_tornWrite(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	es, err := NewFileEventStore(dir, components.NewEventBus())
+	assert.Nil(err)
+	assert.Nil(es.Persist(context.Background(), aggregateId, 0, wrap(eventBusTestEvent1{aggregateId})))
+	assert.Nil(es.Persist(context.Background(), aggregateId, 1, wrap(eventBusTestEvent1{aggregateId})))
+	assert.Nil(es.Close())
+
+	path := filepath.Join(dir, "00000000"+segmentExtension)
+	info, _ := os.Stat(path)
+	assert.Nil(os.Truncate(path, info.Size()-3))
+
+	es, err = NewFileEventStore(dir, components.NewEventBus())
+	assert.Nil(err)
+	defer es.Close()
+	events, err := es.Load(context.Background(), aggregateId)
+	assert.Nil(err)
+	assert.Equal(1, len(events))
+	assert.Nil(es.Persist(context.Background(), aggregateId, 1, wrap(eventBusTestEvent1{aggregateId})))
+}
+
+func TestFileEventStore_corruptRecordBeforeTail(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	es, err := NewFileEventStore(dir, components.NewEventBus())
+	assert.Nil(err)
+	assert.Nil(es.Persist(context.Background(), aggregateId, 0, wrap(eventBusTestEvent1{aggregateId})))
+	assert.Nil(es.Persist(context.Background(), aggregateId, 1, wrap(eventBusTestEvent1{aggregateId})))
+	assert.Nil(es.Close())
+
+	path := filepath.Join(dir, "00000000"+segmentExtension)
+	data, _ := os.ReadFile(path)
+	data[recordHeaderSize+1] ^= 0xff
+	assert.Nil(os.WriteFile(path, data, 0644))
+
+	_, err = NewFileEventStore(dir, components.NewEventBus())
+	assert.True(errors.Is(err, ErrCorruptSegment))
+	info, _ := os.Stat(path)
+	assert.Equal(int64(len(data)), info.Size())
+}
+
+func TestFileEventStore_corruptSealedSegment(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	es, err := NewFileEventStore(dir, components.NewEventBus(), WithSegmentSize(64))
+	assert.Nil(err)
+	assert.Nil(es.Persist(context.Background(), aggregateId, 0, wrap(eventBusTestEvent2{aggregateId, "a name"})))
+	assert.Nil(es.Persist(context.Background(), aggregateId, 1, wrap(eventBusTestEvent2{aggregateId, "a name"})))
+	assert.Nil(es.Close())
+
+	path := filepath.Join(dir, "00000000"+segmentExtension)
+	info, _ := os.Stat(path)
+	assert.Nil(os.Truncate(path, info.Size()-3))
+
+	_, err = NewFileEventStore(dir, components.NewEventBus())
+	assert.True(errors.Is(err, ErrCorruptSegment))
+}
+
+func TestFileEventStore_closed(t *testing.T) {
+	assert := assert.New(t)
+	es, err := NewFileEventStore(t.TempDir(), components.NewEventBus())
+	assert.Nil(err)
+	assert.Nil(es.Close())
+	assert.Nil(es.Close())
+
+	assert.True(errors.Is(es.Persist(context.Background(), aggregateId, 0, wrap(eventBusTestEvent1{aggregateId})), ErrStoreClosed))
+	_, err = es.Load(context.Background(), aggregateId)
+	assert.True(errors.Is(err, ErrStoreClosed))
+	_, err = es.ReadAll(context.Background(), 0, 0)
+	assert.True(errors.Is(err, ErrStoreClosed))
+}
+
+func TestFileEventStore_directoryLocked(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	es, err := NewFileEventStore(dir, components.NewEventBus())
+	assert.Nil(err)
+
+	_, err = NewFileEventStore(dir, components.NewEventBus())
+	assert.True(errors.Is(err, ErrStoreLocked))
+
+	assert.Nil(es.Close())
+	es, err = NewFileEventStore(dir, components.NewEventBus())
+	assert.Nil(err)
+	assert.Nil(es.Close())
+}
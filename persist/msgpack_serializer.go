@@ -0,0 +1,477 @@
+package persist
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+const (
+	msgpackNil   = 0xc0
+	msgpackFalse = 0xc2
+	msgpackTrue  = 0xc3
+)
+
+const (
+	msgpackScalar = iota
+	msgpackString
+	msgpackBinary
+	msgpackArray
+	msgpackMap
+	msgpackExtension
+)
+
+// MessagePackSerializer encodes events as MessagePack. Exported struct fields are written as a map keyed
+// by field name, so fields may be added to or removed from an event type; keys without a matching field
+// are skipped on decoding. Types implementing encoding.BinaryMarshaler, time.Time among them, are written
+// as binary data.
+type MessagePackSerializer struct{}
+
+func (MessagePackSerializer) ContentType() string { return ContentTypeMessagePack }
+
+func (MessagePackSerializer) Marshal(value interface{}) ([]byte, error) {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return nil, errors.New("cannot encode a nil value")
+	}
+	return appendMsgpack(nil, v)
+}
+
+func (MessagePackSerializer) Unmarshal(data []byte, valueType reflect.Type) (interface{}, error) {
+	target := reflect.New(valueType).Elem()
+	if err := decodeMsgpack(&binaryReader{data: data}, target); err != nil {
+		return nil, err
+	}
+	return target.Interface(), nil
+}
+
+func appendMsgpack(buf []byte, v reflect.Value) ([]byte, error) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return append(buf, msgpackNil), nil
+	}
+	if isBinaryMarshaler(v.Type()) {
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		return appendMsgpackBytes(buf, data), err
+	}
+	var err error
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, msgpackTrue), nil
+		}
+		return append(buf, msgpackFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendMsgpackUint(buf, v.Uint()), nil
+	case reflect.Float32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xca), math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendMsgpackString(buf, v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(buf, msgpackNil), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendMsgpackBytes(buf, v.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		buf = appendMsgpackHeader(buf, v.Len(), 0x90, 0xdc)
+		for i := 0; i < v.Len() && err == nil; i++ {
+			buf, err = appendMsgpack(buf, v.Index(i))
+		}
+		return buf, err
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, msgpackNil), nil
+		}
+		buf = appendMsgpackHeader(buf, v.Len(), 0x80, 0xde)
+		iter := v.MapRange()
+		for iter.Next() && err == nil {
+			if buf, err = appendMsgpack(buf, iter.Key()); err == nil {
+				buf, err = appendMsgpack(buf, iter.Value())
+			}
+		}
+		return buf, err
+	case reflect.Ptr:
+		return appendMsgpack(buf, v.Elem())
+	case reflect.Struct:
+		fields := exportedFields(v.Type())
+		buf = appendMsgpackHeader(buf, len(fields), 0x80, 0xde)
+		for i := 0; i < len(fields) && err == nil; i++ {
+			buf = appendMsgpackString(buf, v.Type().Field(fields[i]).Name)
+			buf, err = appendMsgpack(buf, v.Field(fields[i]))
+		}
+		return buf, err
+	}
+	return nil, fmt.Errorf("unsupported kind %v", v.Kind())
+}
+
+func appendMsgpackInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgpackUint(buf, uint64(i))
+	case i >= -32:
+		return append(buf, byte(i))
+	case i >= math.MinInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(i))
+}
+
+func appendMsgpackUint(buf []byte, u uint64) []byte {
+	switch {
+	case u <= math.MaxInt8:
+		return append(buf, byte(u))
+	case u <= math.MaxUint8:
+		return append(buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(u))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xcf), u)
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func appendMsgpackBytes(buf []byte, data []byte) []byte {
+	switch n := len(data); {
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(n))
+	}
+	return append(buf, data...)
+}
+
+// appendMsgpackHeader appends the header of an array or map of n entries: the fix format for fewer than
+// 16 entries, otherwise the 16-bit format code16 or the 32-bit format that follows it.
+func appendMsgpackHeader(buf []byte, n int, fix byte, code16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, code16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, code16+1), uint32(n))
+}
+
+func exportedFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+func decodeMsgpack(r *binaryReader, v reflect.Value) error {
+	start := r.pos
+	code, family, n, err := r.msgpackHeader()
+	if err != nil {
+		return err
+	}
+	if code == msgpackNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	mismatch := func() error {
+		return fmt.Errorf("msgpack format 0x%02x cannot be decoded into %v", code, v.Type())
+	}
+	if isBinaryMarshaler(v.Type()) {
+		if family != msgpackBinary && family != msgpackString {
+			return mismatch()
+		}
+		data, err := r.next(n)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		r.pos = start
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeMsgpack(r, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Bool:
+		if code != msgpackFalse && code != msgpackTrue {
+			return mismatch()
+		}
+		v.SetBool(code == msgpackTrue)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, u, signed, err := r.msgpackInteger(code)
+		if err != nil {
+			return err
+		}
+		if !signed {
+			i = int64(u)
+		}
+		if (!signed && u > math.MaxInt64) || v.OverflowInt(i) {
+			return fmt.Errorf("msgpack integer overflows %v", v.Type())
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, u, signed, err := r.msgpackInteger(code)
+		if err != nil {
+			return err
+		}
+		if signed {
+			u = uint64(i)
+		}
+		if (signed && i < 0) || v.OverflowUint(u) {
+			return fmt.Errorf("msgpack integer overflows %v", v.Type())
+		}
+		v.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch code {
+		case 0xca:
+			bits, err := r.bigEndian(4)
+			v.SetFloat(float64(math.Float32frombits(uint32(bits))))
+			return err
+		case 0xcb:
+			bits, err := r.bigEndian(8)
+			v.SetFloat(math.Float64frombits(bits))
+			return err
+		}
+		i, u, signed, err := r.msgpackInteger(code)
+		if err != nil {
+			return mismatch()
+		}
+		if signed {
+			v.SetFloat(float64(i))
+		} else {
+			v.SetFloat(float64(u))
+		}
+		return nil
+	case reflect.String:
+		if family != msgpackString && family != msgpackBinary {
+			return mismatch()
+		}
+		data, err := r.next(n)
+		v.SetString(string(data))
+		return err
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (family == msgpackBinary || family == msgpackString) {
+			data, err := r.next(n)
+			v.SetBytes(append([]byte{}, data...))
+			return err
+		}
+		if family != msgpackArray {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := decodeMsgpack(r, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Array:
+		if family != msgpackArray {
+			return mismatch()
+		}
+		for i := 0; i < n; i++ {
+			var err error
+			if i < v.Len() {
+				err = decodeMsgpack(r, v.Index(i))
+			} else {
+				err = r.skipMsgpack()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if family != msgpackMap {
+			return mismatch()
+		}
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeMsgpack(r, key); err != nil {
+				return err
+			}
+			if err := decodeMsgpack(r, value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Struct:
+		if family != msgpackMap {
+			return mismatch()
+		}
+		for i := 0; i < n; i++ {
+			var name string
+			if err := decodeMsgpack(r, reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			field, ok := v.Type().FieldByName(name)
+			if !ok || len(field.Index) != 1 || field.PkgPath != "" {
+				if err := r.skipMsgpack(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := decodeMsgpack(r, v.Field(field.Index[0])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported kind %v", v.Kind())
+}
+
+// msgpackHeader reads the format byte of the next value and, for strings, binary data, extensions,
+// arrays and maps, its length. The length of an extension covers its type byte.
+func (r *binaryReader) msgpackHeader() (code byte, family int, n int, err error) {
+	chunk, err := r.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	code = chunk[0]
+	var size int
+	switch {
+	case code&0xe0 == 0xa0:
+		family, n = msgpackString, int(code&0x1f)
+	case code&0xf0 == 0x90:
+		family, n = msgpackArray, int(code&0x0f)
+	case code&0xf0 == 0x80:
+		family, n = msgpackMap, int(code&0x0f)
+	case code >= 0xc4 && code <= 0xc6:
+		family, size = msgpackBinary, 1<<(code-0xc4)
+	case code >= 0xc7 && code <= 0xc9:
+		family, size = msgpackExtension, 1<<(code-0xc7)
+	case code >= 0xd9 && code <= 0xdb:
+		family, size = msgpackString, 1<<(code-0xd9)
+	case code == 0xdc || code == 0xdd:
+		family, size = msgpackArray, 2<<(code-0xdc)
+	case code == 0xde || code == 0xdf:
+		family, size = msgpackMap, 2<<(code-0xde)
+	case code >= 0xd4 && code <= 0xd8:
+		family, n = msgpackExtension, 1+1<<(code-0xd4)
+	case code == 0xc1:
+		return 0, 0, 0, fmt.Errorf("unknown msgpack format 0x%02x", code)
+	default:
+		return code, msgpackScalar, 0, nil
+	}
+	if size > 0 {
+		length, err := r.bigEndian(size)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if family == msgpackExtension {
+			length++
+		}
+		if length > uint64(len(r.data)-r.pos) {
+			return 0, 0, 0, errTruncated
+		}
+		n = int(length)
+	}
+	// every entry of an array or map takes at least a byte, which bounds what a corrupt length allocates
+	if n > len(r.data)-r.pos {
+		return 0, 0, 0, errTruncated
+	}
+	return code, family, n, nil
+}
+
+// msgpackInteger reads the integer following the format byte as a signed or an unsigned value,
+// depending on its format.
+func (r *binaryReader) msgpackInteger(code byte) (int64, uint64, bool, error) {
+	switch {
+	case code <= 0x7f:
+		return 0, uint64(code), false, nil
+	case code >= 0xe0:
+		return int64(int8(code)), 0, true, nil
+	case code >= 0xcc && code <= 0xcf:
+		u, err := r.bigEndian(1 << (code - 0xcc))
+		return 0, u, false, err
+	case code >= 0xd0 && code <= 0xd3:
+		size := 1 << (code - 0xd0)
+		u, err := r.bigEndian(size)
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, 0, true, err
+	}
+	return 0, 0, false, fmt.Errorf("msgpack format 0x%02x is not an integer", code)
+}
+
+func (r *binaryReader) bigEndian(size int) (uint64, error) {
+	chunk, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, b := range chunk {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+func (r *binaryReader) skipMsgpack() error {
+	code, family, n, err := r.msgpackHeader()
+	if err != nil {
+		return err
+	}
+	switch family {
+	case msgpackArray:
+		for i := 0; i < n && err == nil; i++ {
+			err = r.skipMsgpack()
+		}
+		return err
+	case msgpackMap:
+		for i := 0; i < 2*n && err == nil; i++ {
+			err = r.skipMsgpack()
+		}
+		return err
+	case msgpackScalar:
+		switch code {
+		case 0xcc, 0xd0:
+			n = 1
+		case 0xcd, 0xd1:
+			n = 2
+		case 0xce, 0xd2, 0xca:
+			n = 4
+		case 0xcf, 0xd3, 0xcb:
+			n = 8
+		}
+	}
+	_, err = r.next(n)
+	return err
+}
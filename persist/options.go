@@ -0,0 +1,52 @@
+package persist
+
+type Option func(*options)
+
+type options struct {
+	registry    *TypeRegistry
+	serializer  Serializer
+	serializers map[string]Serializer
+	segmentSize int64
+	syncPolicy  SyncPolicy
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		registry:    DefaultTypeRegistry,
+		serializer:  JSONSerializer{},
+		serializers: defaultSerializers(),
+		segmentSize: defaultSegmentSize,
+		syncPolicy:  SyncAlways,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func WithTypeRegistry(registry *TypeRegistry) Option {
+	return func(o *options) {
+		o.registry = registry
+	}
+}
+
+// WithSerializer sets the serializer used for new events. Payloads written by any serializer
+// passed here, or by one of the serializers shipped with this package, remain readable.
+func WithSerializer(serializer Serializer) Option {
+	return func(o *options) {
+		o.serializer = serializer
+		o.serializers[serializer.ContentType()] = serializer
+	}
+}
+
+func WithSegmentSize(bytes int64) Option {
+	return func(o *options) {
+		o.segmentSize = bytes
+	}
+}
+
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+	}
+}
@@ -0,0 +1,176 @@
+package persist
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const sagaExtension = ".saga"
+
+// MemSagaStore keeps saga instances in memory, indexed by their association values.
+type MemSagaStore struct {
+	mu           sync.RWMutex
+	sagas        map[string]map[string]cqrs.SagaState
+	associations map[string]map[string]map[string]bool
+}
+
+func NewMemSagaStore() *MemSagaStore {
+	return &MemSagaStore{
+		sagas:        make(map[string]map[string]cqrs.SagaState),
+		associations: make(map[string]map[string]map[string]bool),
+	}
+}
+
+func (s *MemSagaStore) SaveSaga(ctx context.Context, state cqrs.SagaState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	state.Associations = append([]string{}, state.Associations...)
+	state.Payload = append([]byte{}, state.Payload...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unindex(state.SagaType, state.SagaId)
+	if s.sagas[state.SagaType] == nil {
+		s.sagas[state.SagaType] = make(map[string]cqrs.SagaState)
+		s.associations[state.SagaType] = make(map[string]map[string]bool)
+	}
+	s.sagas[state.SagaType][state.SagaId] = state
+	for _, association := range state.Associations {
+		if s.associations[state.SagaType][association] == nil {
+			s.associations[state.SagaType][association] = make(map[string]bool)
+		}
+		s.associations[state.SagaType][association][state.SagaId] = true
+	}
+	return nil
+}
+
+func (s *MemSagaStore) DeleteSaga(ctx context.Context, sagaType, sagaId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unindex(sagaType, sagaId)
+	delete(s.sagas[sagaType], sagaId)
+	return nil
+}
+
+// FindSagas returns the matching instances ordered by saga ID.
+func (s *MemSagaStore) FindSagas(ctx context.Context, sagaType, association string) ([]cqrs.SagaState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	states := make([]cqrs.SagaState, 0)
+	for sagaId := range s.associations[sagaType][association] {
+		state := s.sagas[sagaType][sagaId]
+		state.Associations = append([]string{}, state.Associations...)
+		state.Payload = append([]byte{}, state.Payload...)
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].SagaId < states[j].SagaId })
+	return states, nil
+}
+
+// unindex removes the association index entries of a saga instance; the caller must hold the lock.
+func (s *MemSagaStore) unindex(sagaType, sagaId string) {
+	previous, ok := s.sagas[sagaType][sagaId]
+	if !ok {
+		return
+	}
+	for _, association := range previous.Associations {
+		delete(s.associations[sagaType][association], sagaId)
+		if len(s.associations[sagaType][association]) == 0 {
+			delete(s.associations[sagaType], association)
+		}
+	}
+}
+
+// FileSagaStore keeps each saga instance in its own file, replaced atomically on every save. The files are
+// read into memory when the store is opened and FindSagas is answered from there, so a directory must not be
+// shared by stores that are open at the same time.
+type FileSagaStore struct {
+	dir   string
+	mu    sync.Mutex
+	index *MemSagaStore
+}
+
+type fileSaga struct {
+	SagaId       string   `json:"sagaId"`
+	SagaType     string   `json:"sagaType"`
+	Associations []string `json:"associations"`
+	Payload      []byte   `json:"payload"`
+}
+
+func NewFileSagaStore(dir string) (*FileSagaStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+sagaExtension))
+	if err != nil {
+		return nil, err
+	}
+	store := &FileSagaStore{dir: dir, index: NewMemSagaStore()}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var record fileSaga
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("%w: saga %s: %v", cqrs.ErrSerialization, filepath.Base(file), err)
+		}
+		state := cqrs.SagaState{SagaId: record.SagaId, SagaType: record.SagaType, Associations: record.Associations, Payload: record.Payload}
+		if err := store.index.SaveSaga(context.Background(), state); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func (s *FileSagaStore) SaveSaga(ctx context.Context, state cqrs.SagaState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	record, err := json.Marshal(fileSaga{SagaId: state.SagaId, SagaType: state.SagaType, Associations: state.Associations, Payload: state.Payload})
+	if err != nil {
+		return fmt.Errorf("%w: %v", cqrs.ErrSerialization, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeFileAtomic(s.path(state.SagaType, state.SagaId), record); err != nil {
+		return err
+	}
+	return s.index.SaveSaga(context.WithoutCancel(ctx), state)
+}
+
+func (s *FileSagaStore) DeleteSaga(ctx context.Context, sagaType, sagaId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(sagaType, sagaId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.index.DeleteSaga(context.WithoutCancel(ctx), sagaType, sagaId)
+}
+
+// FindSagas returns the matching instances ordered by saga ID.
+func (s *FileSagaStore) FindSagas(ctx context.Context, sagaType, association string) ([]cqrs.SagaState, error) {
+	return s.index.FindSagas(ctx, sagaType, association)
+}
+
+// path names the file after both the saga type and the saga ID; hex encoding keeps the separator out of
+// either.
+func (s *FileSagaStore) path(sagaType, sagaId string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(sagaType))+"-"+hex.EncodeToString([]byte(sagaId))+sagaExtension)
+}
@@ -0,0 +1,68 @@
+package persist
+
+import (
+	"context"
+	"github.com/davegarred/cqrs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemSagaStore(t *testing.T) {
+	testSagaStore(t, NewMemSagaStore())
+}
+
+func TestFileSagaStore(t *testing.T) {
+	store, err := NewFileSagaStore(t.TempDir())
+	assert.Nil(t, err)
+	testSagaStore(t, store)
+}
+
+func TestFileSagaStore_reopen(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+	store, err := NewFileSagaStore(dir)
+	assert.Nil(err)
+	state := cqrs.SagaState{SagaId: "saga_1", SagaType: "a_saga", Associations: []string{"order_1", "payment_1"}, Payload: []byte(`{"step":2}`)}
+	assert.Nil(store.SaveSaga(ctx, state))
+	assert.Nil(store.SaveSaga(ctx, cqrs.SagaState{SagaId: "saga_2", SagaType: "a_saga", Associations: []string{"order_2"}}))
+	assert.Nil(store.DeleteSaga(ctx, "a_saga", "saga_2"))
+
+	store, err = NewFileSagaStore(dir)
+	assert.Nil(err)
+	states, err := store.FindSagas(ctx, "a_saga", "payment_1")
+	assert.Nil(err)
+	assert.Equal([]cqrs.SagaState{state}, states)
+	states, err = store.FindSagas(ctx, "a_saga", "order_2")
+	assert.Nil(err)
+	assert.Equal(0, len(states))
+}
+
+func testSagaStore(t *testing.T, store cqrs.SagaStore) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	order := cqrs.SagaState{SagaId: "saga_2", SagaType: "a_saga", Associations: []string{"order_1"}, Payload: []byte(`{}`)}
+	other := cqrs.SagaState{SagaId: "saga_1", SagaType: "a_saga", Associations: []string{"order_1", "payment_1"}}
+	assert.Nil(store.SaveSaga(ctx, order))
+	assert.Nil(store.SaveSaga(ctx, other))
+	assert.Nil(store.SaveSaga(ctx, cqrs.SagaState{SagaId: "saga_3", SagaType: "another_saga", Associations: []string{"order_1"}}))
+
+	states, err := store.FindSagas(ctx, "a_saga", "order_1")
+	assert.Nil(err)
+	assert.Equal([]string{"saga_1", "saga_2"}, []string{states[0].SagaId, states[1].SagaId})
+	assert.Equal([]byte(`{}`), states[1].Payload)
+
+	// saving again replaces the associations
+	other.Associations = []string{"payment_1"}
+	assert.Nil(store.SaveSaga(ctx, other))
+	states, _ = store.FindSagas(ctx, "a_saga", "order_1")
+	assert.Equal(1, len(states))
+	states, _ = store.FindSagas(ctx, "a_saga", "payment_1")
+	assert.Equal("saga_1", states[0].SagaId)
+
+	assert.Nil(store.DeleteSaga(ctx, "a_saga", "saga_1"))
+	states, err = store.FindSagas(ctx, "a_saga", "payment_1")
+	assert.Nil(err)
+	assert.Equal(0, len(states))
+}
@@ -0,0 +1,291 @@
+package persist
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const scheduleExtension = ".schedule"
+
+type MemScheduleStore struct {
+	mu        sync.RWMutex
+	schedules map[string]cqrs.ScheduledMessage
+}
+
+func NewMemScheduleStore() *MemScheduleStore {
+	return &MemScheduleStore{schedules: make(map[string]cqrs.ScheduledMessage)}
+}
+
+func (s *MemScheduleStore) SaveSchedule(ctx context.Context, message cqrs.ScheduledMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedules[message.ScheduleId] = message
+	return nil
+}
+
+func (s *MemScheduleStore) DeleteSchedule(ctx context.Context, scheduleId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.schedules, scheduleId)
+	return nil
+}
+
+func (s *MemScheduleStore) DueSchedules(ctx context.Context, until time.Time) ([]cqrs.ScheduledMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	due := make([]cqrs.ScheduledMessage, 0)
+	for _, message := range s.schedules {
+		if !message.Due.After(until) {
+			due = append(due, message)
+		}
+	}
+	sortSchedules(due)
+	return due, nil
+}
+
+// FileScheduleStore keeps each scheduled message in its own file, serialized like the events of a
+// FileEventStore. Command and event types must be registered with the type registry before messages
+// scheduled by an earlier process can be read back; until then DueSchedules skips them and reports them
+// in its error.
+//
+// The due times of the messages are read into an index when the store is opened, so that DueSchedules
+// only reads the files of the messages that are due. A directory must therefore not be shared by stores
+// that are open at the same time.
+type FileScheduleStore struct {
+	dir     string
+	options options
+	mu      sync.RWMutex
+	index   []scheduleEntry
+	dueAt   map[string]time.Time
+}
+
+// scheduleEntry is the index entry of a scheduled message; the index is kept ordered like sortSchedules
+// orders the messages.
+type scheduleEntry struct {
+	due        time.Time
+	scheduleId string
+}
+
+type fileSchedule struct {
+	Due           time.Time         `json:"due"`
+	Command       bool              `json:"command,omitempty"`
+	MessageType   string            `json:"messageType"`
+	ContentType   string            `json:"contentType"`
+	Payload       []byte            `json:"payload"`
+	CausationId   string            `json:"causationId,omitempty"`
+	CorrelationId string            `json:"correlationId,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+}
+
+// NewFileScheduleStore opens the store, indexing the messages already in the directory. A message whose
+// due time cannot be read is indexed as due at once, so that DueSchedules reports it.
+func NewFileScheduleStore(dir string, opts ...Option) (*FileScheduleStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+scheduleExtension))
+	if err != nil {
+		return nil, err
+	}
+	store := &FileScheduleStore{dir: dir, options: newOptions(opts), dueAt: make(map[string]time.Time)}
+	for _, file := range files {
+		scheduleId, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(file), scheduleExtension))
+		if err != nil {
+			continue
+		}
+		var record struct {
+			Due time.Time `json:"due"`
+		}
+		data, err := os.ReadFile(file)
+		if err != nil || json.Unmarshal(data, &record) != nil {
+			record.Due = time.Time{}
+		}
+		store.indexSchedule(string(scheduleId), record.Due)
+	}
+	return store, nil
+}
+
+func (s *FileScheduleStore) SaveSchedule(ctx context.Context, message cqrs.ScheduledMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var value interface{} = message.Event
+	if message.Command != nil {
+		value = message.Command
+	}
+	messageType, err := s.options.registry.NameOf(value)
+	if err != nil {
+		return err
+	}
+	payload, err := s.options.serializer.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%w: %T: %v", cqrs.ErrSerialization, value, err)
+	}
+	record, err := json.Marshal(fileSchedule{
+		Due:           message.Due,
+		Command:       message.Command != nil,
+		MessageType:   messageType,
+		ContentType:   s.options.serializer.ContentType(),
+		Payload:       payload,
+		CausationId:   message.Metadata.CausationId,
+		CorrelationId: message.Metadata.CorrelationId,
+		Headers:       message.Metadata.Headers,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", cqrs.ErrSerialization, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeFileAtomic(s.path(message.ScheduleId), record); err != nil {
+		return err
+	}
+	s.unindexSchedule(message.ScheduleId)
+	s.indexSchedule(message.ScheduleId, message.Due)
+	return nil
+}
+
+func (s *FileScheduleStore) DeleteSchedule(ctx context.Context, scheduleId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(scheduleId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.unindexSchedule(scheduleId)
+	return nil
+}
+
+func (s *FileScheduleStore) DueSchedules(ctx context.Context, until time.Time) ([]cqrs.ScheduledMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	var scheduleIds []string
+	for _, entry := range s.index {
+		if entry.due.After(until) {
+			break
+		}
+		scheduleIds = append(scheduleIds, entry.scheduleId)
+	}
+	s.mu.RUnlock()
+
+	due := make([]cqrs.ScheduledMessage, 0, len(scheduleIds))
+	var errs []error
+	for _, scheduleId := range scheduleIds {
+		message, err := s.read(s.path(scheduleId), scheduleId)
+		if os.IsNotExist(err) {
+			// deleted since the index was read
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("schedule %s: %w", scheduleId, err))
+			continue
+		}
+		if !message.Due.After(until) {
+			due = append(due, message)
+		}
+	}
+	sortSchedules(due)
+	return due, errors.Join(errs...)
+}
+
+func (s *FileScheduleStore) read(file, scheduleId string) (cqrs.ScheduledMessage, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return cqrs.ScheduledMessage{}, err
+	}
+	var record fileSchedule
+	if err := json.Unmarshal(data, &record); err != nil {
+		return cqrs.ScheduledMessage{}, fmt.Errorf("%w: %v", cqrs.ErrSerialization, err)
+	}
+	messageType, err := s.options.registry.TypeOf(record.MessageType)
+	if err != nil {
+		return cqrs.ScheduledMessage{}, err
+	}
+	serializer, ok := s.options.serializers[record.ContentType]
+	if !ok {
+		return cqrs.ScheduledMessage{}, fmt.Errorf("%w: no serializer for content type %q", cqrs.ErrSerialization, record.ContentType)
+	}
+	value, err := serializer.Unmarshal(record.Payload, messageType)
+	if err != nil {
+		return cqrs.ScheduledMessage{}, fmt.Errorf("%w: %v: %v", cqrs.ErrSerialization, messageType, err)
+	}
+	message := cqrs.ScheduledMessage{
+		ScheduleId: scheduleId,
+		Due:        record.Due,
+		Metadata:   cqrs.Metadata{CausationId: record.CausationId, CorrelationId: record.CorrelationId, Headers: record.Headers},
+	}
+	if record.Command {
+		message.Command, ok = value.(cqrs.Command)
+	} else {
+		message.Event, ok = value.(cqrs.Event)
+	}
+	if !ok {
+		return cqrs.ScheduledMessage{}, fmt.Errorf("%w: %v is neither a cqrs.Command nor a cqrs.Event", cqrs.ErrSerialization, messageType)
+	}
+	return message, nil
+}
+
+func (s *FileScheduleStore) path(scheduleId string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(scheduleId))+scheduleExtension)
+}
+
+// indexSchedule adds a message to the index; the caller must hold the lock.
+func (s *FileScheduleStore) indexSchedule(scheduleId string, due time.Time) {
+	i := s.position(scheduleId, due)
+	s.index = append(s.index, scheduleEntry{})
+	copy(s.index[i+1:], s.index[i:])
+	s.index[i] = scheduleEntry{due, scheduleId}
+	s.dueAt[scheduleId] = due
+}
+
+// unindexSchedule removes a message from the index, if it is there; the caller must hold the lock.
+func (s *FileScheduleStore) unindexSchedule(scheduleId string) {
+	due, ok := s.dueAt[scheduleId]
+	if !ok {
+		return
+	}
+	i := s.position(scheduleId, due)
+	s.index = append(s.index[:i], s.index[i+1:]...)
+	delete(s.dueAt, scheduleId)
+}
+
+func (s *FileScheduleStore) position(scheduleId string, due time.Time) int {
+	return sort.Search(len(s.index), func(i int) bool {
+		entry := s.index[i]
+		if !entry.due.Equal(due) {
+			return entry.due.After(due)
+		}
+		return entry.scheduleId >= scheduleId
+	})
+}
+
+func sortSchedules(messages []cqrs.ScheduledMessage) {
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].Due.Equal(messages[j].Due) {
+			return messages[i].Due.Before(messages[j].Due)
+		}
+		return messages[i].ScheduleId < messages[j].ScheduleId
+	})
+}
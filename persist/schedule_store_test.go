@@ -0,0 +1,93 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var scheduleEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type remindCommand struct {
+	Id string
+}
+
+func (c remindCommand) TargetAggregateId() string { return c.Id }
+
+func TestMemScheduleStore(t *testing.T) {
+	testScheduleStore(t, NewMemScheduleStore())
+}
+
+func TestFileScheduleStore(t *testing.T) {
+	store, err := NewFileScheduleStore(t.TempDir())
+	assert.Nil(t, err)
+	testScheduleStore(t, store)
+}
+
+func testScheduleStore(t *testing.T, store cqrs.ScheduleStore) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	metadata := cqrs.Metadata{CausationId: "a_causation_id", CorrelationId: "a_correlation_id"}
+	later := cqrs.ScheduledMessage{ScheduleId: "later", Due: scheduleEpoch.Add(time.Hour), Command: remindCommand{"an_id"}, Metadata: metadata}
+	sooner := cqrs.ScheduledMessage{ScheduleId: "sooner", Due: scheduleEpoch, Event: eventBusTestEvent2{"an_id", "a deadline"}}
+	cancelled := cqrs.ScheduledMessage{ScheduleId: "cancelled", Due: scheduleEpoch, Event: eventBusTestEvent2{"an_id", "cancelled"}}
+	for _, message := range []cqrs.ScheduledMessage{later, sooner, cancelled} {
+		assert.Nil(store.SaveSchedule(ctx, message))
+	}
+	assert.Nil(store.DeleteSchedule(ctx, "cancelled"))
+	assert.Nil(store.DeleteSchedule(ctx, "unknown"))
+
+	due, err := store.DueSchedules(ctx, scheduleEpoch.Add(time.Minute))
+	assert.Nil(err)
+	assert.Equal(1, len(due))
+	assert.Equal("sooner", due[0].ScheduleId)
+	assert.Equal(eventBusTestEvent2{"an_id", "a deadline"}, due[0].Event)
+
+	due, err = store.DueSchedules(ctx, scheduleEpoch.Add(time.Hour))
+	assert.Nil(err)
+	assert.Equal(2, len(due))
+	assert.Equal("later", due[1].ScheduleId)
+	assert.True(later.Due.Equal(due[1].Due))
+	assert.Equal(remindCommand{"an_id"}, due[1].Command)
+	assert.Nil(due[1].Event)
+	assert.Equal(metadata, due[1].Metadata)
+}
+
+func TestFileScheduleStore_corrupt(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileScheduleStore(dir)
+	assert.Nil(t, os.WriteFile(store.path("a_schedule"), []byte("{"), 0644))
+	store, _ = NewFileScheduleStore(dir)
+	assert.Nil(t, store.SaveSchedule(context.Background(), cqrs.ScheduledMessage{ScheduleId: "readable", Due: scheduleEpoch, Command: remindCommand{"an_id"}}))
+
+	due, err := store.DueSchedules(context.Background(), scheduleEpoch)
+
+	assert.True(t, errors.Is(err, cqrs.ErrSerialization))
+	assert.Contains(t, err.Error(), "a_schedule")
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, "readable", due[0].ScheduleId)
+}
+
+func TestFileScheduleStore_readsOnlyDueFiles(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store, _ := NewFileScheduleStore(dir)
+	ctx := context.Background()
+	assert.Nil(store.SaveSchedule(ctx, cqrs.ScheduledMessage{ScheduleId: "sooner", Due: scheduleEpoch, Command: remindCommand{"an_id"}}))
+	assert.Nil(store.SaveSchedule(ctx, cqrs.ScheduledMessage{ScheduleId: "later", Due: scheduleEpoch.Add(time.Hour), Command: remindCommand{"an_id"}}))
+	store, _ = NewFileScheduleStore(dir)
+	assert.Nil(os.WriteFile(store.path("later"), []byte("{"), 0644))
+
+	due, err := store.DueSchedules(ctx, scheduleEpoch)
+	assert.Nil(err)
+	assert.Equal(1, len(due))
+	assert.Equal("sooner", due[0].ScheduleId)
+
+	_, err = store.DueSchedules(ctx, scheduleEpoch.Add(time.Hour))
+	assert.True(errors.Is(err, cqrs.ErrSerialization))
+}
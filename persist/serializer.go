@@ -0,0 +1,67 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+)
+
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeGob         = "application/x-gob"
+	ContentTypeBinary      = "application/x-cqrs-binary"
+	ContentTypeMessagePack = "application/x-msgpack"
+)
+
+// Serializer converts event payloads to and from bytes. The content type is recorded alongside every
+// stored payload so that a stream written with several serializers can still be read back.
+type Serializer interface {
+	ContentType() string
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, valueType reflect.Type) (interface{}, error)
+}
+
+type JSONSerializer struct{}
+
+func (JSONSerializer) ContentType() string { return ContentTypeJSON }
+
+func (JSONSerializer) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONSerializer) Unmarshal(data []byte, valueType reflect.Type) (interface{}, error) {
+	target := reflect.New(valueType)
+	if err := json.Unmarshal(data, target.Interface()); err != nil {
+		return nil, err
+	}
+	return target.Elem().Interface(), nil
+}
+
+type GobSerializer struct{}
+
+func (GobSerializer) ContentType() string { return ContentTypeGob }
+
+func (GobSerializer) Marshal(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobSerializer) Unmarshal(data []byte, valueType reflect.Type) (interface{}, error) {
+	target := reflect.New(valueType)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(target.Interface()); err != nil {
+		return nil, err
+	}
+	return target.Elem().Interface(), nil
+}
+
+func defaultSerializers() map[string]Serializer {
+	serializers := make(map[string]Serializer)
+	for _, serializer := range []Serializer{JSONSerializer{}, GobSerializer{}, BinarySerializer{}, MessagePackSerializer{}} {
+		serializers[serializer.ContentType()] = serializer
+	}
+	return serializers
+}
@@ -0,0 +1,225 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/components"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var serializers = []Serializer{JSONSerializer{}, GobSerializer{}, BinarySerializer{}, MessagePackSerializer{}}
+
+func TestSerializers_roundTrip(t *testing.T) {
+	event := newSerializerTestEvent()
+	for _, serializer := range serializers {
+		t.Run(serializer.ContentType(), func(t *testing.T) {
+			payload, err := serializer.Marshal(event)
+			assert.Nil(t, err)
+
+			value, err := serializer.Unmarshal(payload, reflect.TypeOf(event))
+			assert.Nil(t, err)
+			assert.Equal(t, event, value)
+		})
+	}
+}
+
+func TestSerializers_nilPointers(t *testing.T) {
+	nested := &serializerTestNested{"nested", 1}
+	event := serializerTestPointers{Id: aggregateId, Items: []*serializerTestNested{nil, nested}, Array: [2]*serializerTestNested{nested, nil}, Named: map[string]*serializerTestNested{"none": nil}}
+	// gob rejects nil pointers in collections, which is an error rather than a panic
+	for _, serializer := range []Serializer{JSONSerializer{}, BinarySerializer{}, MessagePackSerializer{}} {
+		t.Run(serializer.ContentType(), func(t *testing.T) {
+			payload, err := serializer.Marshal(event)
+			assert.Nil(t, err)
+			value, err := serializer.Unmarshal(payload, reflect.TypeOf(event))
+			assert.Nil(t, err)
+			assert.Equal(t, event, value)
+
+			payload, err = serializer.Marshal((*serializerTestPointers)(nil))
+			assert.Nil(t, err)
+			value, err = serializer.Unmarshal(payload, reflect.TypeOf(&event))
+			assert.Nil(t, err)
+			assert.Equal(t, (*serializerTestPointers)(nil), value)
+		})
+	}
+}
+
+func TestBinarySerializer_addedField(t *testing.T) {
+	assert := assert.New(t)
+	serializer := BinarySerializer{}
+	payload, err := serializer.Marshal(eventBusTestEvent2{aggregateId, "a name"})
+	assert.Nil(err)
+
+	value, err := serializer.Unmarshal(payload, reflect.TypeOf(eventBusTestEvent1{}))
+
+	assert.Nil(err)
+	assert.Equal(eventBusTestEvent1{aggregateId}, value)
+}
+
+func TestBinarySerializer_truncated(t *testing.T) {
+	serializer := BinarySerializer{}
+	payload, _ := serializer.Marshal(newSerializerTestEvent())
+
+	_, err := serializer.Unmarshal(payload[:len(payload)-2], reflect.TypeOf(serializerTestEvent{}))
+
+	assert.NotNil(t, err)
+}
+
+func TestMessagePackSerializer_wireFormat(t *testing.T) {
+	payload, err := MessagePackSerializer{}.Marshal(eventBusTestEvent2{"id", "n"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("\x82\xa2Id\xa2id\xa4Name\xa1n"), payload)
+}
+
+func TestMessagePackSerializer_changedFields(t *testing.T) {
+	assert := assert.New(t)
+	serializer := MessagePackSerializer{}
+	payload, err := serializer.Marshal(newSerializerTestEvent())
+	assert.Nil(err)
+
+	value, err := serializer.Unmarshal(payload, reflect.TypeOf(eventBusTestEvent2{}))
+
+	assert.Nil(err)
+	assert.Equal(eventBusTestEvent2{Id: aggregateId}, value)
+}
+
+func TestMessagePackSerializer_corrupt(t *testing.T) {
+	serializer := MessagePackSerializer{}
+	payload, _ := serializer.Marshal(newSerializerTestEvent())
+
+	_, err := serializer.Unmarshal(payload[:len(payload)-2], reflect.TypeOf(serializerTestEvent{}))
+	assert.NotNil(t, err)
+	_, err = serializer.Unmarshal([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}, reflect.TypeOf([]int{}))
+	assert.NotNil(t, err)
+	_, err = serializer.Unmarshal(payload, reflect.TypeOf(""))
+	assert.NotNil(t, err)
+}
+
+func TestMemEventStore_mixedContentTypes(t *testing.T) {
+	assert := assert.New(t)
+	eventBus := components.NewEventBus()
+	event1 := eventBusTestEvent1{aggregateId}
+	event2 := eventBusTestEvent2{aggregateId, "a name"}
+	event3 := eventBusTestEvent2{aggregateId, "another name"}
+	es := NewMemEventStore(eventBus).(*MemEventStore)
+	assert.Nil(es.Persist(context.Background(), aggregateId, 0, wrap(event1)))
+	es.options.serializer = GobSerializer{}
+	assert.Nil(es.Persist(context.Background(), aggregateId, 1, wrap(event2)))
+	es.options.serializer = BinarySerializer{}
+	assert.Nil(es.Persist(context.Background(), aggregateId, 2, wrap(event3)))
+
+	events, err := es.Load(context.Background(), aggregateId)
+
+	assert.Nil(err)
+	assert.Equal([]cqrs.Event{event1, event2, event3}, cqrs.Events(events))
+	assert.Equal(ContentTypeJSON, es.eventMap[aggregateId][0].contentType)
+	assert.Equal(ContentTypeGob, es.eventMap[aggregateId][1].contentType)
+	assert.Equal(ContentTypeBinary, es.eventMap[aggregateId][2].contentType)
+}
+
+func TestMemEventStore_unknownContentType(t *testing.T) {
+	es := NewMemEventStore(components.NewEventBus(), WithSerializer(customContentTypeSerializer{}))
+	assert.Nil(t, es.Persist(context.Background(), aggregateId, 0, wrap(eventBusTestEvent1{aggregateId})))
+
+	events, err := es.Load(context.Background(), aggregateId)
+	assert.Nil(t, err)
+	assert.Equal(t, []cqrs.Event{eventBusTestEvent1{aggregateId}}, cqrs.Events(events))
+
+	reader := NewMemEventStore(components.NewEventBus()).(*MemEventStore)
+	reader.eventMap = es.(*MemEventStore).eventMap
+	_, err = reader.Load(context.Background(), aggregateId)
+	assert.True(t, errors.Is(err, cqrs.ErrSerialization))
+}
+
+func BenchmarkSerializers_Marshal(b *testing.B) {
+	for _, event := range []cqrs.Event{eventBusTestEvent2{aggregateId, "a name"}, newSerializerTestEvent()} {
+		for _, serializer := range serializers {
+			b.Run(reflect.TypeOf(event).Name()+"/"+serializer.ContentType(), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					serializer.Marshal(event)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSerializers_Unmarshal(b *testing.B) {
+	for _, event := range []cqrs.Event{eventBusTestEvent2{aggregateId, "a name"}, newSerializerTestEvent()} {
+		for _, serializer := range serializers {
+			payload, _ := serializer.Marshal(event)
+			eventType := reflect.TypeOf(event)
+			b.Run(eventType.Name()+"/"+serializer.ContentType(), func(b *testing.B) {
+				b.ReportMetric(float64(len(payload)), "bytes/payload")
+				for i := 0; i < b.N; i++ {
+					serializer.Unmarshal(payload, eventType)
+				}
+			})
+		}
+	}
+}
+
+type serializerTestEvent struct {
+	Id       string
+	Count    int
+	Negative int32
+	Total    uint64
+	Price    float64
+	Ratio    float32
+	Active   bool
+	Created  time.Time
+	Tags     []string
+	Scores   []int
+	Labels   map[string]string
+	Raw      []byte
+	Nested   serializerTestNested
+	Optional *serializerTestNested
+	Items    []serializerTestNested
+}
+
+type serializerTestPointers struct {
+	Id    string
+	Items []*serializerTestNested
+	Array [2]*serializerTestNested
+	Named map[string]*serializerTestNested
+}
+
+func (e serializerTestPointers) AggregateId() string { return e.Id }
+
+type serializerTestNested struct {
+	Name     string
+	Quantity int
+}
+
+func (e serializerTestEvent) AggregateId() string { return e.Id }
+
+func newSerializerTestEvent() serializerTestEvent {
+	return serializerTestEvent{
+		Id:       aggregateId,
+		Count:    42,
+		Negative: -7,
+		Total:    1 << 40,
+		Price:    19.99,
+		Ratio:    0.5,
+		Active:   true,
+		Created:  time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC),
+		Tags:     []string{"a", "b"},
+		Scores:   []int{1, -2, 300},
+		Labels:   map[string]string{"region": "us-west"},
+		Raw:      []byte{0, 1, 2},
+		Nested:   serializerTestNested{"nested", 3},
+		Optional: &serializerTestNested{"optional", 1},
+		Items:    []serializerTestNested{{"first", 1}, {"second", 2}},
+	}
+}
+
+type customContentTypeSerializer struct {
+	JSONSerializer
+}
+
+func (customContentTypeSerializer) ContentType() string { return "application/x-test" }
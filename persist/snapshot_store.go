@@ -0,0 +1,121 @@
+package persist
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const snapshotExtension = ".snapshot"
+
+// MemSnapshotStore keeps the latest snapshot of every aggregate in memory.
+type MemSnapshotStore struct {
+	mu        sync.RWMutex
+	snapshots map[string]cqrs.Snapshot
+}
+
+func NewMemSnapshotStore() *MemSnapshotStore {
+	return &MemSnapshotStore{snapshots: make(map[string]cqrs.Snapshot)}
+}
+
+func (s *MemSnapshotStore) SaveSnapshot(ctx context.Context, snapshot cqrs.Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	snapshot.Payload = append([]byte{}, snapshot.Payload...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[snapshot.AggregateId] = snapshot
+	return nil
+}
+
+func (s *MemSnapshotStore) LoadSnapshot(ctx context.Context, aggregateId string) (*cqrs.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot, ok := s.snapshots[aggregateId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", cqrs.ErrSnapshotNotFound, aggregateId)
+	}
+	snapshot.Payload = append([]byte{}, snapshot.Payload...)
+	return &snapshot, nil
+}
+
+// FileSnapshotStore keeps the latest snapshot of every aggregate in its own file. Snapshots are written
+// to a temporary file and renamed into place, so a crash never leaves a partially written snapshot behind.
+type FileSnapshotStore struct {
+	dir string
+}
+
+func NewFileSnapshotStore(dir string) (*FileSnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSnapshotStore{dir: dir}, nil
+}
+
+func (s *FileSnapshotStore) SaveSnapshot(ctx context.Context, snapshot cqrs.Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cqrs.ErrSerialization, err)
+	}
+	return writeFileAtomic(s.path(snapshot.AggregateId), payload)
+}
+
+func (s *FileSnapshotStore) LoadSnapshot(ctx context.Context, aggregateId string) (*cqrs.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	payload, err := os.ReadFile(s.path(aggregateId))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", cqrs.ErrSnapshotNotFound, aggregateId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &cqrs.Snapshot{}
+	if err := json.Unmarshal(payload, snapshot); err != nil {
+		return nil, fmt.Errorf("%w: snapshot of %s: %v", cqrs.ErrSerialization, aggregateId, err)
+	}
+	return snapshot, nil
+}
+
+// path hex encodes the aggregate ID so that any ID maps to a valid file name.
+func (s *FileSnapshotStore) path(aggregateId string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(aggregateId))+snapshotExtension)
+}
+
+// writeFileAtomic writes the data to a temporary file next to path and renames it into place, so that
+// readers see either the previous content or the new content in full.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
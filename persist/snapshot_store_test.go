@@ -0,0 +1,63 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemSnapshotStore(t *testing.T) {
+	testSnapshotStore(t, NewMemSnapshotStore())
+}
+
+func TestFileSnapshotStore(t *testing.T) {
+	store, err := NewFileSnapshotStore(t.TempDir())
+	assert.Nil(t, err)
+	testSnapshotStore(t, store)
+}
+
+func testSnapshotStore(t *testing.T, store cqrs.SnapshotStore) {
+	assert := assert.New(t)
+	_, err := store.LoadSnapshot(context.Background(), aggregateId)
+	assert.True(errors.Is(err, cqrs.ErrSnapshotNotFound))
+
+	snapshot := cqrs.Snapshot{AggregateId: aggregateId, AggregateType: "an.aggregate", Version: 3, SchemaVersion: 1, Timestamp: time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC), Payload: []byte("state")}
+	assert.Nil(store.SaveSnapshot(context.Background(), snapshot))
+	snapshot.Version, snapshot.Payload = 5, []byte("later state")
+	assert.Nil(store.SaveSnapshot(context.Background(), snapshot))
+
+	loaded, err := store.LoadSnapshot(context.Background(), aggregateId)
+	assert.Nil(err)
+	assert.Equal(snapshot, *loaded)
+}
+
+func TestFileSnapshotStore_reopen(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store, _ := NewFileSnapshotStore(dir)
+	assert.Nil(store.SaveSnapshot(context.Background(), cqrs.Snapshot{AggregateId: "an/odd id", Version: 2, Payload: []byte("state")}))
+
+	store, _ = NewFileSnapshotStore(dir)
+	loaded, err := store.LoadSnapshot(context.Background(), "an/odd id")
+
+	assert.Nil(err)
+	assert.Equal(2, loaded.Version)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Equal(1, len(files))
+}
+
+func TestFileSnapshotStore_corrupt(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileSnapshotStore(dir)
+	assert.Nil(t, os.WriteFile(store.path(aggregateId), []byte("{"), 0644))
+
+	_, err := store.LoadSnapshot(context.Background(), aggregateId)
+
+	assert.True(t, errors.Is(err, cqrs.ErrSerialization))
+}
@@ -0,0 +1,115 @@
+package persist
+
+import (
+	"fmt"
+	"github.com/davegarred/cqrs"
+	"reflect"
+	"sync"
+)
+
+var DefaultTypeRegistry = NewTypeRegistry()
+
+type UnknownEventTypeError struct {
+	Name string
+}
+
+func (e *UnknownEventTypeError) Error() string {
+	return fmt.Sprintf("unknown event type %q, it must be registered before it can be loaded", e.Name)
+}
+
+func (e *UnknownEventTypeError) Is(target error) bool {
+	return target == cqrs.ErrSerialization
+}
+
+// TypeRegistry maps stable names to Go types so that stored payloads can be rehydrated by a different
+// process than the one that wrote them. Types that were never registered explicitly are named after
+// their package path and type name the first time they are serialized.
+type TypeRegistry struct {
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{types: make(map[string]reflect.Type), names: make(map[reflect.Type]string)}
+}
+
+func RegisterEvent(event cqrs.Event) error {
+	return DefaultTypeRegistry.Register(event)
+}
+
+func RegisterEventName(name string, event cqrs.Event) error {
+	return DefaultTypeRegistry.RegisterName(name, event)
+}
+
+// RegisterCommand registers a command type, for the stores that persist scheduled commands.
+func RegisterCommand(command cqrs.Command) error {
+	return DefaultTypeRegistry.Register(command)
+}
+
+func (r *TypeRegistry) Register(value interface{}) error {
+	return r.RegisterName(defaultTypeName(reflect.TypeOf(value)), value)
+}
+
+func (r *TypeRegistry) RegisterName(name string, value interface{}) error {
+	valueType := reflect.TypeOf(value)
+	if name == "" || valueType == nil {
+		return fmt.Errorf("%w: cannot register %T under name %q", cqrs.ErrMisconfiguration, value, name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.types[name]; ok && existing != valueType {
+		return fmt.Errorf("%w: type name %q is already registered to %v", cqrs.ErrMisconfiguration, name, existing)
+	}
+	if existing, ok := r.names[valueType]; ok && existing != name {
+		return fmt.Errorf("%w: %v is already registered as %q", cqrs.ErrMisconfiguration, valueType, existing)
+	}
+	r.types[name] = valueType
+	r.names[valueType] = name
+	return nil
+}
+
+// NameOf returns the name the value's type is stored under, naming it after its package path and type
+// name if it was never registered. It fails if that default name is registered to another type.
+func (r *TypeRegistry) NameOf(value interface{}) (string, error) {
+	valueType := reflect.TypeOf(value)
+	r.mu.RLock()
+	name, ok := r.names[valueType]
+	r.mu.RUnlock()
+	if ok {
+		return name, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name, ok := r.names[valueType]; ok {
+		return name, nil
+	}
+	name = defaultTypeName(valueType)
+	if existing, taken := r.types[name]; taken {
+		return "", fmt.Errorf("%w: %v has no registered name and its default name %q is registered to %v", cqrs.ErrMisconfiguration, valueType, name, existing)
+	}
+	r.types[name] = valueType
+	r.names[valueType] = name
+	return name, nil
+}
+
+func (r *TypeRegistry) TypeOf(name string) (reflect.Type, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	valueType, ok := r.types[name]
+	if !ok {
+		return nil, &UnknownEventTypeError{name}
+	}
+	return valueType, nil
+}
+
+func defaultTypeName(valueType reflect.Type) string {
+	if valueType == nil {
+		return ""
+	}
+	if valueType.Kind() == reflect.Ptr {
+		return "*" + defaultTypeName(valueType.Elem())
+	}
+	return valueType.PkgPath() + "." + valueType.Name()
+}
@@ -0,0 +1,75 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/davegarred/cqrs"
+	"github.com/davegarred/cqrs/components"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeRegistry_defaultName(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewTypeRegistry()
+
+	name, err := registry.NameOf(eventBusTestEvent1{})
+
+	assert.Nil(err)
+	assert.Equal("github.com/davegarred/cqrs/persist.eventBusTestEvent1", name)
+	eventType, err := registry.TypeOf(name)
+	assert.Nil(err)
+	assert.Equal(reflect.TypeOf(eventBusTestEvent1{}), eventType)
+}
+
+func TestTypeRegistry_explicitName(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewTypeRegistry()
+
+	assert.Nil(registry.RegisterName("event1.v1", eventBusTestEvent1{}))
+
+	name, err := registry.NameOf(eventBusTestEvent1{})
+	assert.Nil(err)
+	assert.Equal("event1.v1", name)
+	eventType, err := registry.TypeOf("event1.v1")
+	assert.Nil(err)
+	assert.Equal(reflect.TypeOf(eventBusTestEvent1{}), eventType)
+}
+
+func TestTypeRegistry_conflictingRegistrations(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewTypeRegistry()
+	assert.Nil(registry.RegisterName("event", eventBusTestEvent1{}))
+
+	assert.True(errors.Is(registry.RegisterName("event", eventBusTestEvent2{}), cqrs.ErrMisconfiguration))
+	assert.True(errors.Is(registry.RegisterName("another name", eventBusTestEvent1{}), cqrs.ErrMisconfiguration))
+	assert.Nil(registry.RegisterName("event", eventBusTestEvent1{}))
+}
+
+func TestTypeRegistry_defaultNameTaken(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewTypeRegistry()
+	assert.Nil(registry.RegisterName("github.com/davegarred/cqrs/persist.eventBusTestEvent1", eventBusTestEvent2{}))
+
+	_, err := registry.NameOf(eventBusTestEvent1{})
+
+	assert.True(errors.Is(err, cqrs.ErrMisconfiguration))
+	es := NewMemEventStore(components.NewEventBus(), WithTypeRegistry(registry))
+	err = es.Persist(context.Background(), aggregateId, 0, wrap(eventBusTestEvent1{aggregateId}))
+	assert.True(errors.Is(err, cqrs.ErrMisconfiguration))
+	_, err = es.Load(context.Background(), aggregateId)
+	assert.True(errors.Is(err, cqrs.ErrStreamNotFound))
+}
+
+func TestTypeRegistry_unknownName(t *testing.T) {
+	registry := NewTypeRegistry()
+
+	_, err := registry.TypeOf("not.registered")
+
+	unknown, ok := err.(*UnknownEventTypeError)
+	assert.True(t, ok)
+	assert.Equal(t, "not.registered", unknown.Name)
+	assert.True(t, errors.Is(err, cqrs.ErrSerialization))
+}
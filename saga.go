@@ -0,0 +1,19 @@
+package cqrs
+
+import "context"
+
+// SagaState is the serialized form of a running saga instance. Associations are the values that tie
+// events to the instance.
+type SagaState struct {
+	SagaId       string
+	SagaType     string
+	Associations []string
+	Payload      []byte
+}
+
+type SagaStore interface {
+	SaveSaga(ctx context.Context, state SagaState) error
+	DeleteSaga(ctx context.Context, sagaType, sagaId string) error
+	// FindSagas returns the instances of the saga type associated with the value.
+	FindSagas(ctx context.Context, sagaType, association string) ([]SagaState, error)
+}
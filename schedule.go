@@ -0,0 +1,26 @@
+package cqrs
+
+import (
+	"context"
+	"time"
+)
+
+// ScheduledMessage is a command to dispatch, or a deadline event to publish, once Due has passed. Exactly
+// one of Command and Event is set. Metadata is the metadata of the context the message was scheduled
+// with.
+type ScheduledMessage struct {
+	ScheduleId string
+	Due        time.Time
+	Command    Command
+	Event      Event
+	Metadata   Metadata
+}
+
+type ScheduleStore interface {
+	SaveSchedule(ctx context.Context, message ScheduledMessage) error
+	// DeleteSchedule does nothing for an unknown ID.
+	DeleteSchedule(ctx context.Context, scheduleId string) error
+	// DueSchedules returns the messages due at or before the time, earliest first. Messages that cannot be
+	// read are skipped and reported in the error, which is then returned along with the other messages.
+	DueSchedules(ctx context.Context, until time.Time) ([]ScheduledMessage, error)
+}
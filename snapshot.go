@@ -0,0 +1,29 @@
+package cqrs
+
+import (
+	"context"
+	"time"
+)
+
+// Snapshot is the serialized state of an aggregate after the event with sequence number Version.
+type Snapshot struct {
+	AggregateId   string
+	AggregateType string
+	Version       int
+	SchemaVersion int
+	Timestamp     time.Time
+	Payload       []byte
+}
+
+type SnapshotStore interface {
+	SaveSnapshot(ctx context.Context, snapshot Snapshot) error
+	LoadSnapshot(ctx context.Context, aggregateId string) (*Snapshot, error)
+}
+
+// Snapshotter is implemented by aggregates whose state can be captured in a snapshot. Snapshots taken
+// under a different SnapshotSchemaVersion than the aggregate currently reports are discarded.
+type Snapshotter interface {
+	SnapshotSchemaVersion() int
+	MarshalSnapshot() ([]byte, error)
+	UnmarshalSnapshot(data []byte) error
+}